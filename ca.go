@@ -0,0 +1,265 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxLeaves limits the number of cached certificates. When it is exceeded,
+// the cache is cleared.
+const maxLeaves = 256
+
+// A localCA is a root certificate authority that is created once and kept
+// in the user config dir. It issues short-lived certificates for the
+// hostnames the server is reached by, so trusting it once gets rid of the
+// browser warning.
+type localCA struct {
+	dir  string
+	cert *x509.Certificate
+	key  crypto.Signer
+	// hosts are the hostnames besides localhost the CA issues certificates
+	// for. A `*.` prefix matches all subdomains.
+	hosts []string
+
+	mu sync.Mutex
+	// leafKey is shared by all issued certificates, as generating keys
+	// is slow. Its type is set with `-key-type`.
+	leafKey crypto.Signer
+	leaves  map[string]*tls.Certificate
+}
+
+// defaultCADir returns the directory the local CA is kept in.
+func defaultCADir() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "simplehttp2server"), nil
+}
+
+// loadCA loads the local CA from dir, creating it if it doesn’t exist yet.
+func loadCA(dir string) (*localCA, error) {
+	certPath := filepath.Join(dir, "ca.pem")
+	if _, err := os.Stat(certPath); os.IsNotExist(err) {
+		if err := createCA(dir); err != nil {
+			return nil, err
+		}
+		log.Printf("Created local CA %s", certPath)
+	}
+
+	ca := &localCA{dir: dir, leaves: map[string]*tls.Certificate{}}
+	if err := ca.load(); err != nil {
+		return nil, err
+	}
+	if err := ca.renew(); err != nil {
+		return nil, err
+	}
+	return ca, nil
+}
+
+func (ca *localCA) load() error {
+	keyPath := filepath.Join(ca.dir, "ca-key.pem")
+	pair, err := tls.LoadX509KeyPair(filepath.Join(ca.dir, "ca.pem"), keyPath)
+	if err != nil {
+		return err
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return err
+	}
+	key, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return fmt.Errorf("Unsupported key in %s", keyPath)
+	}
+	ca.cert, ca.key = cert, key
+	return nil
+}
+
+// renew replaces the CA with a new one if it expires soon. As the new CA
+// has to be trusted again, this is logged loudly.
+func (ca *localCA) renew() error {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	if !expiresSoon(ca.cert) {
+		return nil
+	}
+	expiry := ca.cert.NotAfter
+	if err := createCA(ca.dir); err != nil {
+		return err
+	}
+	if err := ca.load(); err != nil {
+		return err
+	}
+	ca.leaves = map[string]*tls.Certificate{}
+	log.Printf("WARNING: The local CA expires on %s and has been replaced. Trust the new CA %s to get rid of certificate warnings.", expiry.Format(time.RFC3339), filepath.Join(ca.dir, "ca.pem"))
+	return nil
+}
+
+func createCA(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	key, err := newKey(caKeyType)
+	if err != nil {
+		return err
+	}
+	serialNumber, err := newSerialNumber()
+	if err != nil {
+		return err
+	}
+	hostname, _ := os.Hostname()
+	template := x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject: pkix.Name{
+			Organization: generatedOrganizations[:1],
+			CommonName:   "simplehttp2server development CA " + hostname,
+		},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(caValidFor),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, key.Public(), key)
+	if err != nil {
+		return err
+	}
+	block, err := pemBlockForKey(key)
+	if err != nil {
+		return err
+	}
+	if err := writePEM(filepath.Join(dir, "ca-key.pem"), block, 0600); err != nil {
+		return err
+	}
+	return writePEM(filepath.Join(dir, "ca.pem"), &pem.Block{Type: "CERTIFICATE", Bytes: der}, 0644)
+}
+
+func newSerialNumber() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+func writePEM(path string, block *pem.Block, perm os.FileMode) error {
+	return ioutil.WriteFile(path, pem.EncodeToMemory(block), perm)
+}
+
+// issue creates a certificate for the given hostnames and IP addresses,
+// signed by the CA.
+func (ca *localCA) issue(hosts []string, key crypto.Signer, validFor time.Duration) (*tls.Certificate, error) {
+	return createCertificate(hosts, key, validFor, ca.cert, ca.key)
+}
+
+// createCertificate creates a certificate for the given hostnames and IP
+// addresses, signed by parent. Without a parent, the certificate is
+// self-signed.
+func createCertificate(hosts []string, key crypto.Signer, validFor time.Duration, parent *x509.Certificate, parentKey crypto.Signer) (*tls.Certificate, error) {
+	serialNumber, err := newSerialNumber()
+	if err != nil {
+		return nil, err
+	}
+	template := x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject: pkix.Name{
+			Organization: generatedOrganizations[:1],
+			CommonName:   hosts[0],
+		},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(validFor),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	if _, ok := key.(*rsa.PrivateKey); ok {
+		template.KeyUsage |= x509.KeyUsageKeyEncipherment
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, h)
+		}
+	}
+	if parent == nil {
+		parent, parentKey = &template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, parent, key.Public(), parentKey)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, nil
+}
+
+// allowed reports whether the CA issues certificates for name. As the CA
+// is trusted for every hostname, it only signs localhost and its subdomains
+// and the configured hosts, not any name a client sends.
+func (ca *localCA) allowed(name string) bool {
+	if name == "localhost" || strings.HasSuffix(name, ".localhost") {
+		return true
+	}
+	for _, host := range ca.hosts {
+		if host == name || strings.HasPrefix(host, "*.") && strings.HasSuffix(name, host[1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetCertificate returns a certificate for the hostname the client asked
+// for using SNI, issuing one if needed. Clients connecting to an IP address
+// get a certificate for the address they connected to.
+func (ca *localCA) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if name == "" {
+		name = "localhost"
+		if addr, ok := hello.Conn.LocalAddr().(*net.TCPAddr); ok {
+			name = addr.IP.String()
+		}
+	} else if !ca.allowed(name) {
+		log.Printf("Not issuing a certificate for %s, add it with -cert-hosts", name)
+		return nil, fmt.Errorf("No certificate for %s", name)
+	}
+
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	if cert, ok := ca.leaves[name]; ok && time.Until(cert.Leaf.NotAfter) > leafValidFor/2 {
+		return cert, nil
+	}
+	if ca.leafKey == nil {
+		key, err := newKey(*keyType)
+		if err != nil {
+			return nil, err
+		}
+		ca.leafKey = key
+	}
+	cert, err := ca.issue([]string{name}, ca.leafKey, leafValidFor)
+	if err != nil {
+		log.Printf("Error issuing certificate for %s: %s", name, err)
+		return nil, err
+	}
+	log.Printf("Issued certificate for %s", name)
+	if len(ca.leaves) >= maxLeaves {
+		ca.leaves = map[string]*tls.Certificate{}
+	}
+	ca.leaves[name] = cert
+	return cert, nil
+}
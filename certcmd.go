@@ -0,0 +1,350 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// certCommand implements `simplehttp2server cert create|inspect|export`.
+func certCommand(args []string) int {
+	commands := map[string]func([]string) int{
+		"create":  certCreateCommand,
+		"inspect": certInspectCommand,
+		"export":  certExportCommand,
+	}
+	if len(args) == 0 || commands[args[0]] == nil {
+		fmt.Fprintf(os.Stderr, "Usage: simplehttp2server cert create|inspect|export [options]\n")
+		return 2
+	}
+	return commands[args[0]](args[1:])
+}
+
+// caPaths returns the paths of the certificate and key of the local CA.
+func caPaths() (string, string, error) {
+	dir, err := defaultCADir()
+	if err != nil {
+		return "", "", err
+	}
+	return filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca-key.pem"), nil
+}
+
+func certCreateCommand(args []string) int {
+	fs := flag.NewFlagSet("cert create", flag.ExitOnError)
+	hosts := fs.String("hosts", "localhost", "Comma-separated hostnames and IP addresses of the certificate")
+	days := fs.Int("days", 90, "Number of days the certificate is valid")
+	keyType := fs.String("key-type", "rsa2048", "Key type, rsa2048, rsa4096, p256, p384 or ed25519")
+	certPath := fs.String("cert", "cert.pem", "File to write the certificate to")
+	keyPath := fs.String("key", "key.pem", "File to write the private key to")
+	selfSigned := fs.Bool("self-signed", false, "Create a self-signed certificate instead of one issued by the local CA")
+	force := fs.Bool("force", false, "Overwrite existing files")
+	fs.Parse(args)
+
+	if !*force {
+		for _, path := range []string{*certPath, *keyPath} {
+			if _, err := os.Stat(path); err == nil {
+				fmt.Fprintf(os.Stderr, "%s already exists, use -force to overwrite it\n", path)
+				return 1
+			}
+		}
+	}
+	names := []string{}
+	for _, host := range strings.Split(*hosts, ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			names = append(names, host)
+		}
+	}
+	if len(names) == 0 || *days <= 0 {
+		fmt.Fprintf(os.Stderr, "A certificate needs at least one host and one day of validity\n")
+		return 2
+	}
+
+	key, err := newKey(*keyType)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 2
+	}
+	var parent *x509.Certificate
+	var parentKey crypto.Signer
+	if !*selfSigned {
+		dir, err := defaultCADir()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error finding the local CA: %s\n", err)
+			return 1
+		}
+		ca, err := loadCA(dir)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading the local CA: %s\n", err)
+			return 1
+		}
+		parent, parentKey = ca.cert, ca.key
+	}
+	cert, err := createCertificate(names, key, time.Duration(*days)*24*time.Hour, parent, parentKey)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating certificate: %s\n", err)
+		return 1
+	}
+
+	block, err := pemBlockForKey(key)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error encoding key: %s\n", err)
+		return 1
+	}
+	if err := writePEM(*keyPath, block, 0600); err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing %s: %s\n", *keyPath, err)
+		return 1
+	}
+	if err := writePEM(*certPath, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}, 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing %s: %s\n", *certPath, err)
+		return 1
+	}
+	fmt.Printf("Created %s and %s for %s, valid until %s\n", *certPath, *keyPath, strings.Join(names, ", "), cert.Leaf.NotAfter.Format(time.RFC3339))
+	return 0
+}
+
+func certInspectCommand(args []string) int {
+	fs := flag.NewFlagSet("cert inspect", flag.ExitOnError)
+	certPath := fs.String("cert", "cert.pem", "Certificate to inspect")
+	keyPath := fs.String("key", "key.pem", "Private key to check against the certificate, if it exists")
+	inspectCA := fs.Bool("ca", false, "Inspect the local CA")
+	fs.Parse(args)
+
+	if *inspectCA {
+		var err error
+		if *certPath, *keyPath, err = caPaths(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error finding the local CA: %s\n", err)
+			return 1
+		}
+	}
+	cert, err := readCertificate(*certPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading %s: %s\n", *certPath, err)
+		return 1
+	}
+
+	status := 0
+	fmt.Printf("Certificate: %s\n", *certPath)
+	fmt.Printf("Subject:     %s\n", cert.Subject)
+	fmt.Printf("Issuer:      %s\n", describeIssuer(cert))
+	fmt.Printf("Hostnames:   %s\n", strings.Join(certificateHosts(cert), ", "))
+	fmt.Printf("Valid from:  %s\n", cert.NotBefore.Format(time.RFC3339))
+	fmt.Printf("Valid until: %s (%s)\n", cert.NotAfter.Format(time.RFC3339), describeExpiry(cert.NotAfter))
+	fmt.Printf("Key:         %s\n", describeKey(cert.PublicKey))
+	fmt.Printf("SHA-256:     %s\n", fingerprint(cert))
+	if time.Now().After(cert.NotAfter) {
+		status = 1
+	}
+	if _, err := os.Stat(*keyPath); err == nil {
+		key, err := readKey(*keyPath)
+		switch {
+		case err != nil:
+			fmt.Printf("Private key: %s can’t be read: %s\n", *keyPath, err)
+			status = 1
+		case !keyMatches(cert, key):
+			fmt.Printf("Private key: %s does NOT match\n", *keyPath)
+			status = 1
+		default:
+			fmt.Printf("Private key: %s matches\n", *keyPath)
+		}
+	}
+	return status
+}
+
+func certExportCommand(args []string) int {
+	fs := flag.NewFlagSet("cert export", flag.ExitOnError)
+	format := fs.String("format", "der", "Export format, der or p12")
+	certPath := fs.String("cert", "cert.pem", "Certificate to export")
+	keyPath := fs.String("key", "key.pem", "Private key to include in a PKCS#12 file")
+	exportCA := fs.Bool("ca", false, "Export the local CA, for importing it into trust stores")
+	out := fs.String("out", "", "File to write to (default the certificate with the extension of the format)")
+	password := fs.String("password", "", "Password of the PKCS#12 file")
+	legacy := fs.Bool("legacy", false, "Use the legacy PKCS#12 encryption older devices require")
+	fs.Parse(args)
+
+	if *exportCA {
+		var err error
+		if *certPath, _, err = caPaths(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error finding the local CA: %s\n", err)
+			return 1
+		}
+	}
+	cert, err := readCertificate(*certPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading %s: %s\n", *certPath, err)
+		return 1
+	}
+	if *out == "" {
+		*out = strings.TrimSuffix(filepath.Base(*certPath), filepath.Ext(*certPath)) + "." + *format
+	}
+
+	var data []byte
+	switch *format {
+	case "der":
+		data = cert.Raw
+	case "p12":
+		data, err = encodePKCS12(cert, *keyPath, *exportCA, *password, *legacy)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error exporting %s: %s\n", *certPath, err)
+			return 1
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "Invalid format %s, must be der or p12\n", *format)
+		return 2
+	}
+	if err := ioutil.WriteFile(*out, data, 0600); err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing %s: %s\n", *out, err)
+		return 1
+	}
+	fmt.Printf("Exported %s to %s\n", *certPath, *out)
+	return 0
+}
+
+// encodePKCS12 encodes cert, its key and the local CA if it issued cert.
+// The key of the CA never leaves the config dir, so the CA is exported as a
+// trust store.
+func encodePKCS12(cert *x509.Certificate, keyPath string, isCA bool, password string, legacy bool) ([]byte, error) {
+	encoder := pkcs12.Modern
+	if legacy {
+		encoder = pkcs12.Legacy
+	}
+	if isCA {
+		return encoder.EncodeTrustStore([]*x509.Certificate{cert}, password)
+	}
+	key, err := readKey(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	if !keyMatches(cert, key) {
+		return nil, fmt.Errorf("%s doesn’t match the certificate", keyPath)
+	}
+	return encoder.Encode(key, cert, issuerChain(cert), password)
+}
+
+// readCertificate reads the first certificate of a PEM or DER file.
+func readCertificate(path string) (*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	for rest := data; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type == "CERTIFICATE" {
+			return x509.ParseCertificate(block.Bytes)
+		}
+	}
+	return x509.ParseCertificate(data)
+}
+
+// readKey reads a PEM encoded private key.
+func readKey(path string) (crypto.Signer, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found")
+	}
+	var key interface{}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported key type %T", key)
+	}
+	return signer, nil
+}
+
+// keyMatches reports whether key is the private key of cert.
+func keyMatches(cert *x509.Certificate, key crypto.Signer) bool {
+	pub, ok := key.Public().(interface{ Equal(crypto.PublicKey) bool })
+	return ok && pub.Equal(cert.PublicKey)
+}
+
+// issuerChain returns the local CA if it issued cert, so it is included
+// when the certificate is exported.
+func issuerChain(cert *x509.Certificate) []*x509.Certificate {
+	caPath, _, err := caPaths()
+	if err != nil {
+		return nil
+	}
+	ca, err := readCertificate(caPath)
+	if err != nil || cert.CheckSignatureFrom(ca) != nil || cert.Equal(ca) {
+		return nil
+	}
+	return []*x509.Certificate{ca}
+}
+
+func certificateHosts(cert *x509.Certificate) []string {
+	hosts := append([]string{}, cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		hosts = append(hosts, ip.String())
+	}
+	return hosts
+}
+
+func describeIssuer(cert *x509.Certificate) string {
+	switch {
+	case cert.Subject.String() == cert.Issuer.String() && cert.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature) == nil:
+		return "self-signed"
+	case len(issuerChain(cert)) > 0:
+		return cert.Issuer.String() + " (the local CA)"
+	}
+	return cert.Issuer.String()
+}
+
+func describeExpiry(notAfter time.Time) string {
+	left := time.Until(notAfter)
+	if left < 0 {
+		return fmt.Sprintf("EXPIRED %d days ago", int(-left.Hours()/24))
+	}
+	return fmt.Sprintf("expires in %d days", int(left.Hours()/24))
+}
+
+func describeKey(pub interface{}) string {
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		return fmt.Sprintf("RSA %d", k.N.BitLen())
+	case *ecdsa.PublicKey:
+		return "ECDSA " + k.Curve.Params().Name
+	case ed25519.PublicKey:
+		return "Ed25519"
+	}
+	return fmt.Sprintf("%T", pub)
+}
+
+// fingerprint returns the SHA-256 fingerprint of cert, as browsers show it.
+func fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, ":")
+}
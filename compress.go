@@ -0,0 +1,464 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// precompressedEncodings are the encodings of precompressed siblings, like
+// `app.js.br`, in order of preference.
+var precompressedEncodings = []struct {
+	coding, ext string
+}{
+	{"br", ".br"},
+	{"gzip", ".gz"},
+}
+
+// acceptedEncodings parses an Accept-Encoding header into the quality of
+// each coding.
+func acceptedEncodings(header string) map[string]float64 {
+	accepted := map[string]float64{}
+	for _, part := range strings.Split(header, ",") {
+		params := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(params[0]))
+		if coding == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if value, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = value
+				}
+			}
+		}
+		accepted[coding] = q
+	}
+	return accepted
+}
+
+// acceptsEncoding reports whether coding is acceptable, explicitly or by a
+// `*`.
+func acceptsEncoding(accepted map[string]float64, coding string) bool {
+	if q, ok := accepted[coding]; ok {
+		return q > 0
+	}
+	q, ok := accepted["*"]
+	return ok && q > 0
+}
+
+// servePrecompressed serves a precompressed sibling of the requested file
+// if there is one for an encoding the client accepts, and reports whether
+// it did. The sibling is only used if the file itself exists, so clients
+// without support for the encoding get the file.
+func servePrecompressed(w http.ResponseWriter, r *http.Request, fs http.FileSystem) bool {
+	name := path.Clean("/" + r.URL.Path)
+	if strings.HasSuffix(r.URL.Path, "/") {
+		name = path.Join(name, "index.html")
+	}
+	f, err := fs.Open(name)
+	if err != nil {
+		return false
+	}
+	fi, err := f.Stat()
+	f.Close()
+	if err != nil || fi.IsDir() {
+		return false
+	}
+
+	accepted := acceptedEncodings(r.Header.Get("Accept-Encoding"))
+	vary := false
+	for _, encoding := range precompressedEncodings {
+		sibling, err := fs.Open(name + encoding.ext)
+		if err != nil {
+			continue
+		}
+		defer sibling.Close()
+		if !vary {
+			varyAcceptEncoding(w.Header())
+			vary = true
+		}
+		if !acceptsEncoding(accepted, encoding.coding) {
+			continue
+		}
+		sfi, err := sibling.Stat()
+		if err != nil || sfi.IsDir() {
+			continue
+		}
+
+		typ := mime.TypeByExtension(path.Ext(name))
+		if typ == "" {
+			typ = "application/octet-stream"
+		}
+		log.Printf("--> Serving precompressed %s", name+encoding.ext)
+		w.Header().Set("Content-Type", typ)
+		w.Header().Set("Content-Encoding", encoding.coding)
+		http.ServeContent(w, r, name, sfi.ModTime(), sibling)
+		return true
+	}
+	return false
+}
+
+// An encoder compresses responses with a content coding at a level.
+type encoder struct {
+	coding string
+	level  int
+}
+
+// writer returns a writer compressing into w.
+func (e encoder) writer(w io.Writer) (io.WriteCloser, error) {
+	switch e.coding {
+	case "br":
+		return brotli.NewWriterLevel(w, e.level), nil
+	case "zstd":
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(e.level)))
+	}
+	return gzip.NewWriterLevel(w, e.level)
+}
+
+func (e encoder) compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := e.writer(&buf)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+var (
+	defaultLevels = map[string]int{"br": 5, "zstd": 3, "gzip": gzip.DefaultCompression}
+	levelRanges   = map[string][2]int{"br": {0, 11}, "zstd": {1, 22}, "gzip": {gzip.HuffmanOnly, gzip.BestCompression}}
+)
+
+// parseEncoders parses the `-compress` flag, a comma-separated list of
+// codings with an optional level, in order of preference.
+func parseEncoders(list string) ([]encoder, error) {
+	encoders := []encoder{}
+	if list == "" || list == "none" {
+		return encoders, nil
+	}
+	for _, entry := range strings.Split(list, ",") {
+		parts := strings.SplitN(strings.TrimSpace(entry), ":", 2)
+		level, ok := defaultLevels[parts[0]]
+		if !ok {
+			return nil, fmt.Errorf("Invalid encoding %s, must be br, zstd or gzip", parts[0])
+		}
+		if len(parts) == 2 {
+			var err error
+			level, err = strconv.Atoi(parts[1])
+			if r := levelRanges[parts[0]]; err != nil || level < r[0] || level > r[1] {
+				return nil, fmt.Errorf("Invalid level %s for %s, must be between %d and %d", parts[1], parts[0], r[0], r[1])
+			}
+		}
+		encoders = append(encoders, encoder{parts[0], level})
+	}
+	return encoders, nil
+}
+
+// compressible reports whether a MIME type matches one of the types of the
+// allowlist, which may end in a wildcard like `text/*`.
+func compressible(typ string, allowlist []string) bool {
+	typ, _, _ = mime.ParseMediaType(typ)
+	for _, allowed := range allowlist {
+		if allowed == typ || strings.HasSuffix(allowed, "/*") && strings.HasPrefix(typ, strings.TrimSuffix(allowed, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// maxCompressionCacheSize limits the memory used by the compression cache.
+// When it is exceeded, the cache is cleared.
+const maxCompressionCacheSize = 64 << 20
+
+// maxBufferedSize is the size up to which responses are compressed as a
+// whole and cached. Larger responses are compressed as they are written.
+const maxBufferedSize = 1 << 20
+
+// A compressionCache holds compressed responses by coding, level and hash
+// of the uncompressed content, so identical content is only compressed
+// once.
+type compressionCache struct {
+	mu      sync.Mutex
+	size    int
+	entries map[string][]byte
+}
+
+func (cc *compressionCache) compress(e encoder, data []byte) ([]byte, error) {
+	key := fmt.Sprintf("%s:%d:%x", e.coding, e.level, sha256.Sum256(data))
+	cc.mu.Lock()
+	compressed, ok := cc.entries[key]
+	cc.mu.Unlock()
+	if ok {
+		return compressed, nil
+	}
+
+	compressed, err := e.compress(data)
+	if err != nil {
+		return nil, err
+	}
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if cc.entries == nil || cc.size+len(compressed) > maxCompressionCacheSize {
+		cc.entries = map[string][]byte{}
+		cc.size = 0
+	}
+	cc.entries[key] = compressed
+	cc.size += len(compressed)
+	return compressed, nil
+}
+
+// A compressor compresses responses on the fly with the first encoder the
+// client accepts.
+type compressor struct {
+	encoders  []encoder
+	allowlist []string
+	minSize   int
+	cache     compressionCache
+}
+
+// responseCompressor compresses the responses of all sites. It is set up
+// from the flags at startup.
+var responseCompressor *compressor
+
+func newCompressor(encodings, types string, minSize int) (*compressor, error) {
+	encoders, err := parseEncoders(encodings)
+	if err != nil {
+		return nil, err
+	}
+	c := &compressor{encoders: encoders, minSize: minSize}
+	for _, typ := range strings.Split(types, ",") {
+		if typ = strings.TrimSpace(typ); typ != "" {
+			c.allowlist = append(c.allowlist, typ)
+		}
+	}
+	return c, nil
+}
+
+// Handler wraps h to compress its responses. Whether a response is
+// compressed is decided when its header is written, from its status,
+// Content-Type, Content-Length and Content-Encoding. Other responses pass
+// through unchanged.
+func (c *compressor) Handler(h http.Handler) http.Handler {
+	if c == nil || len(c.encoders) == 0 {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cw := &compressWriter{ResponseWriter: w, c: c, r: r}
+		h.ServeHTTP(cw, r)
+		cw.close()
+	})
+}
+
+type compressState int
+
+const (
+	// Before the header is written.
+	undecided compressState = iota
+	// The response isn’t compressed.
+	passThrough
+	// The response is held until it is complete, so it can be compressed
+	// as a whole and cached. It is sent uncompressed if it ends up smaller
+	// than the minimum size.
+	buffering
+	// The response is compressed as it is written.
+	streaming
+)
+
+// A compressWriter compresses a response with the first encoder the client
+// accepts.
+type compressWriter struct {
+	http.ResponseWriter
+	c       *compressor
+	r       *http.Request
+	state   compressState
+	code    int
+	encoder encoder
+	buf     bytes.Buffer
+	stream  io.WriteCloser
+}
+
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// eligible reports whether a response with the given status and header can
+// be compressed.
+func (c *compressor) eligible(code int, header http.Header) bool {
+	switch {
+	case code < 200, code == http.StatusNoContent, code == http.StatusPartialContent, code == http.StatusNotModified:
+		return false
+	case header.Get("Content-Encoding") != "":
+		return false
+	}
+	return compressible(header.Get("Content-Type"), c.allowlist)
+}
+
+// varyAcceptEncoding adds Accept-Encoding to the Vary header unless it is
+// already listed, e.g. by servePrecompressed.
+func varyAcceptEncoding(header http.Header) {
+	for _, value := range header.Values("Vary") {
+		for _, field := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(field), "Accept-Encoding") {
+				return
+			}
+		}
+	}
+	header.Add("Vary", "Accept-Encoding")
+}
+
+func (cw *compressWriter) WriteHeader(code int) {
+	if cw.state != undecided {
+		return
+	}
+	cw.code = code
+	header := cw.Header()
+	if !cw.c.eligible(code, header) {
+		cw.passThrough()
+		return
+	}
+	varyAcceptEncoding(header)
+
+	accepted := acceptedEncodings(cw.r.Header.Get("Accept-Encoding"))
+	found := false
+	for _, e := range cw.c.encoders {
+		if acceptsEncoding(accepted, e.coding) {
+			cw.encoder, found = e, true
+			break
+		}
+	}
+	length, err := strconv.Atoi(header.Get("Content-Length"))
+	known := err == nil
+	switch {
+	case !found, known && length < cw.c.minSize:
+		cw.passThrough()
+	case cw.r.Method == "HEAD":
+		// The header of a HEAD response matches the one of a GET response,
+		// except for the unknown length.
+		cw.setEncoding()
+		cw.passThrough()
+	case known && length > maxBufferedSize:
+		cw.startStream()
+	default:
+		cw.state = buffering
+	}
+}
+
+func (cw *compressWriter) passThrough() {
+	cw.state = passThrough
+	cw.ResponseWriter.WriteHeader(cw.code)
+}
+
+func (cw *compressWriter) setEncoding() {
+	header := cw.Header()
+	header.Del("Content-Length")
+	header.Del("Accept-Ranges")
+	header.Set("Content-Encoding", cw.encoder.coding)
+}
+
+func (cw *compressWriter) startStream() {
+	cw.setEncoding()
+	stream, err := cw.encoder.writer(cw.ResponseWriter)
+	if err != nil {
+		log.Printf("Error compressing %s with %s: %s", cw.r.URL.Path, cw.encoder.coding, err)
+		cw.Header().Del("Content-Encoding")
+		cw.passThrough()
+		cw.ResponseWriter.Write(cw.buf.Bytes())
+		return
+	}
+	cw.state = streaming
+	cw.stream = stream
+	cw.ResponseWriter.WriteHeader(cw.code)
+	stream.Write(cw.buf.Bytes())
+	cw.buf.Reset()
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if cw.state == undecided {
+		if cw.Header().Get("Content-Type") == "" {
+			cw.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		cw.WriteHeader(http.StatusOK)
+	}
+	switch cw.state {
+	case buffering:
+		n, err := cw.buf.Write(b)
+		if cw.buf.Len() > maxBufferedSize {
+			cw.startStream()
+		}
+		return n, err
+	case streaming:
+		return cw.stream.Write(b)
+	}
+	return cw.ResponseWriter.Write(b)
+}
+
+// Flush sends what has been written so far, so streamed responses are
+// compressed as they are written instead of being held.
+func (cw *compressWriter) Flush() {
+	if cw.state == undecided {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.state == buffering {
+		cw.startStream()
+	}
+	if f, ok := cw.stream.(interface{ Flush() error }); ok && cw.state == streaming {
+		f.Flush()
+	}
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// close completes the response.
+func (cw *compressWriter) close() {
+	switch cw.state {
+	case undecided:
+		cw.WriteHeader(http.StatusOK)
+		if cw.state == buffering {
+			cw.close()
+		}
+	case buffering:
+		data := cw.buf.Bytes()
+		if len(data) < cw.c.minSize {
+			cw.passThrough()
+			cw.ResponseWriter.Write(data)
+			return
+		}
+		compressed, err := cw.c.cache.compress(cw.encoder, data)
+		if err != nil {
+			log.Printf("Error compressing %s with %s: %s", cw.r.URL.Path, cw.encoder.coding, err)
+			cw.passThrough()
+			cw.ResponseWriter.Write(data)
+			return
+		}
+		cw.setEncoding()
+		cw.Header().Set("Content-Length", strconv.Itoa(len(compressed)))
+		cw.passThrough()
+		cw.ResponseWriter.Write(compressed)
+	case streaming:
+		if err := cw.stream.Close(); err != nil {
+			log.Printf("Error compressing %s with %s: %s", cw.r.URL.Path, cw.encoder.coding, err)
+		}
+	}
+}
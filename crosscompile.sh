@@ -1,6 +1,6 @@
 #!/bin/bash
 
-go get -d ./...
+go mod download
 for target in darwin:amd64 linux:amd64 linux:386 linux:arm windows:amd64; do
   echo "Compiling $target"
   export GOOS=$(echo $target | cut -d: -f1) GOARCH=$(echo $target | cut -d: -f2)
@@ -3,11 +3,23 @@ package main
 import (
 	"regexp"
 	"regexp/syntax"
+	"strconv"
 	"strings"
 )
 
 func CompileExtGlob(extglob string) (*regexp.Regexp, error) {
-	ctx := globctx{glob: extglob}
+	return compileGlob(globctx{glob: extglob})
+}
+
+// CompileSourcePattern compiles a Firebase `source` pattern. On top of the
+// extglob syntax, a path segment `:name` captures a single segment and
+// `:name*` captures the remainder of the path. Captures are available as
+// named subexpressions of the returned regexp.
+func CompileSourcePattern(source string) (*regexp.Regexp, error) {
+	return compileGlob(globctx{glob: source, captures: true})
+}
+
+func compileGlob(ctx globctx) (*regexp.Regexp, error) {
 	ctx.compileGlobstarPrefix()
 
 	if err := ctx.compileExpression(); err != nil {
@@ -17,10 +29,59 @@ func CompileExtGlob(extglob string) (*regexp.Regexp, error) {
 	return regexp.Compile("^" + string(ctx.regexp) + "$")
 }
 
+// ExpandDestination replaces every `:name` in dest with the value the
+// subexpression `name` of pattern captured in match. Subexpressions can also
+// be referenced by their index as `:1`, `:2` and so on, and a `*` after a
+// name, as in `:post*`, is dropped. Names that aren’t subexpressions of
+// pattern are left untouched.
+func ExpandDestination(dest string, pattern *regexp.Regexp, match []string) string {
+	values := map[string]string{}
+	for i, name := range pattern.SubexpNames() {
+		if i == 0 || i >= len(match) {
+			continue
+		}
+		values[strconv.Itoa(i)] = match[i]
+		if name != "" {
+			values[name] = match[i]
+		}
+	}
+
+	result := make([]byte, 0, len(dest))
+	for i := 0; i < len(dest); {
+		if dest[i] != ':' {
+			result = append(result, dest[i])
+			i += 1
+			continue
+		}
+		end := i + 1 + identifierLength(dest[i+1:])
+		if value, ok := values[dest[i+1:end]]; ok && end > i+1 {
+			result = append(result, value...)
+			if end < len(dest) && dest[end] == '*' {
+				end += 1
+			}
+		} else {
+			result = append(result, dest[i:end]...)
+		}
+		i = end
+	}
+	return string(result)
+}
+
+func identifierLength(s string) int {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !(c == '_' || '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z') {
+			return i
+		}
+	}
+	return len(s)
+}
+
 type globctx struct {
 	glob       string
 	regexp     []byte
 	pos, depth int
+	captures   bool
 }
 
 func (c *globctx) compileExpression() error {
@@ -77,6 +138,8 @@ func (c *globctx) compileExpression() error {
 			if err := c.compileCharacterClass(); err != nil {
 				return err
 			}
+		case ':':
+			c.compileCapture()
 		case '.', '^', '$', '(', '{':
 			c.regexp = append(c.regexp, '\\', curr)
 			c.pos += 1
@@ -158,6 +221,30 @@ func (c *globctx) compileCharacterClass() error {
 	return &syntax.Error{Code: syntax.ErrMissingBracket, Expr: c.glob}
 }
 
+func (c *globctx) compileCapture() {
+	n := identifierLength(c.glob[c.pos+1:])
+	if !c.captures || c.depth > 0 || n == 0 || (c.pos > 0 && c.glob[c.pos-1] != '/') {
+		c.regexp = append(c.regexp, ':')
+		c.pos += 1
+		return
+	}
+
+	name := c.glob[c.pos+1 : c.pos+1+n]
+	c.pos += 1 + n
+	if strings.HasPrefix(c.glob[c.pos:], "*") {
+		// The slash in front of `:name*` is optional, so `/blog/:post*`
+		// matches `/blog` as well.
+		if len(c.regexp) > 0 && c.regexp[len(c.regexp)-1] == '/' {
+			c.regexp = append(c.regexp[:len(c.regexp)-1], "(?:/(?P<"+name+">.*))?"...)
+		} else {
+			c.regexp = append(c.regexp, "(?P<"+name+">.*)"...)
+		}
+		c.pos += 1
+	} else {
+		c.regexp = append(c.regexp, "(?P<"+name+">[^/]+)"...)
+	}
+}
+
 func (c *globctx) compileEscapeSequence() error {
 	if c.pos+1 == len(c.glob) {
 		return &syntax.Error{Code: syntax.ErrTrailingBackslash, Expr: c.glob}
@@ -299,3 +299,78 @@ func Test_CompileExtGlob(t *testing.T) {
 		}
 	}
 }
+
+type CaptureEntry struct {
+	Source      string
+	Path        string
+	Destination string
+	Expanded    string
+}
+
+var (
+	captureTable = []CaptureEntry{
+		{
+			Source:      "/blog/:post*",
+			Path:        "/blog/2017/06/hello",
+			Destination: "/news/:post",
+			Expanded:    "/news/2017/06/hello",
+		},
+		{
+			Source:      "/blog/:post*",
+			Path:        "/blog",
+			Destination: "/news/:post",
+			Expanded:    "/news/",
+		},
+		{
+			Source:      "/users/:id/profile",
+			Path:        "/users/42/profile",
+			Destination: "/profile.html?id=:id",
+			Expanded:    "/profile.html?id=42",
+		},
+		{
+			Source:      "/:lang/**/*.html",
+			Path:        "/de/a/b/index.html",
+			Destination: "https://example.com:8080/:lang/:unknown",
+			Expanded:    "https://example.com:8080/de/:unknown",
+		},
+		{
+			Source:      "/a:b",
+			Path:        "/a:b",
+			Destination: "/:b",
+			Expanded:    "/:b",
+		},
+	}
+)
+
+func Test_CompileSourcePattern(t *testing.T) {
+	for _, entry := range captureTable {
+		r, err := CompileSourcePattern(entry.Source)
+		if err != nil {
+			t.Fatalf("Couldn’t compile source %s: %s", entry.Source, err)
+		}
+		t.Logf("Compiled source %s: %s", entry.Source, r)
+		match := r.FindStringSubmatch(entry.Path)
+		if match == nil {
+			t.Fatalf("%s didn’t match %s", entry.Source, entry.Path)
+		}
+		if expanded := ExpandDestination(entry.Destination, r, match); expanded != entry.Expanded {
+			t.Fatalf("%s expanded to %s, expected %s", entry.Destination, expanded, entry.Expanded)
+		}
+	}
+
+	r, err := CompileSourcePattern("/users/:id")
+	if err != nil {
+		t.Fatalf("Couldn’t compile source: %s", err)
+	}
+	if r.MatchString("/users/42/profile") {
+		t.Fatalf("%s matched more than one segment", r)
+	}
+
+	r, err = CompileSourcePattern("/blog/:post*")
+	if err != nil {
+		t.Fatalf("Couldn’t compile source: %s", err)
+	}
+	if r.MatchString("/blogger") {
+		t.Fatalf("%s matched a longer segment", r)
+	}
+}
@@ -3,125 +3,550 @@ package main
 import (
 	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
+	"net/url"
 	"os"
-	"path/filepath"
+	"regexp"
 	"strings"
 )
 
 type FirebaseManifest struct {
-	Public    string `json:"public"`
-	Redirects []struct {
+	// Target and Site name one of several sites in a `hosting` array.
+	Target string `json:"target"`
+	Site   string `json:"site"`
+	Public string `json:"public"`
+	// Ignore are extglobs of files in the public dir that are never served.
+	Ignore []string `json:"ignore"`
+	// Mounts map URL prefixes to directories served in addition to the
+	// public dir. This is not supported by Firebase.
+	Mounts    map[string]string `json:"mounts"`
+	CleanURLs bool              `json:"cleanUrls"`
+	// AppAssociation is `AUTO` or `NONE`.
+	AppAssociation string `json:"appAssociation"`
+	I18n           *struct {
+		Root string `json:"root"`
+	} `json:"i18n"`
+	// TrailingSlash is nil when unset, which only adds a trailing slash
+	// for directory indices.
+	TrailingSlash *bool `json:"trailingSlash,omitempty"`
+	Redirects     []struct {
 		Source      string `json:"source"`
+		Regex       string `json:"regex"`
 		Destination string `json:"destination"`
 		Type        int    `json:"type,omitempty"`
 	} `json:"redirects"`
 	Rewrites []struct {
-		Source      string `json:"source"`
-		Destination string `json:"destination"`
+		Source      string          `json:"source"`
+		Regex       string          `json:"regex"`
+		Destination string          `json:"destination"`
+		Function    rewriteFunction `json:"function"`
+		Run         *struct {
+			ServiceID string `json:"serviceId"`
+			Region    string `json:"region"`
+		} `json:"run"`
 	} `json:"rewrites"`
 	Headers []struct {
 		Source  string `json:"source"`
+		Regex   string `json:"regex"`
 		Headers []struct {
 			Key   string `json:"key"`
 			Value string `json:"value"`
 		} `json:"headers"`
 	} `json:"headers"`
-	Hosting *FirebaseManifest `json:"Hosting"`
+	// NotFoundPages are custom 404 pages for parts of the site. This is not
+	// supported by Firebase, which always serves `/404.html`.
+	NotFoundPages []struct {
+		Source      string `json:"source"`
+		Regex       string `json:"regex"`
+		Destination string `json:"destination"`
+	} `json:"notFoundPages"`
+	Hosting hostingConfigs `json:"Hosting"`
 }
 
-func (mf FirebaseManifest) processRedirects(w http.ResponseWriter, r *http.Request) (bool, error) {
-	for _, redirect := range mf.Redirects {
-		pattern, err := CompileExtGlob("/" + strings.TrimPrefix(redirect.Source, "/"))
-		if err != nil {
-			return false, fmt.Errorf("Invalid redirect extglob %s: %s", redirect.Source, err)
+// hostingConfigs is the `hosting` key, which is either a single object or
+// an array of objects for projects with several sites.
+type hostingConfigs []*FirebaseManifest
+
+func (hc *hostingConfigs) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '[' {
+		return json.Unmarshal(data, (*[]*FirebaseManifest)(hc))
+	}
+	mf := &FirebaseManifest{}
+	if err := json.Unmarshal(data, mf); err != nil {
+		return err
+	}
+	*hc = hostingConfigs{mf}
+	return nil
+}
+
+// name returns the name a site can be selected with.
+func (mf FirebaseManifest) name() string {
+	if mf.Target != "" {
+		return mf.Target
+	}
+	return mf.Site
+}
+
+// Targets returns the names of all sites of the manifest.
+func (mf FirebaseManifest) Targets() []string {
+	targets := []string{}
+	for _, hosting := range mf.Hosting {
+		if name := hosting.name(); name != "" {
+			targets = append(targets, name)
+		}
+	}
+	return targets
+}
+
+// selectSite returns the hosting config for target. An empty target selects
+// the only site of the manifest.
+func (mf FirebaseManifest) selectSite(target string) (*FirebaseManifest, error) {
+	if len(mf.Hosting) == 0 {
+		if target != "" {
+			return nil, fmt.Errorf("No hosting config for target %s", target)
 		}
-		if pattern.MatchString(r.URL.Path) {
-			http.Redirect(w, r, redirect.Destination, redirect.Type)
-			return true, nil
+		return nil, nil
+	}
+	if target == "" {
+		if len(mf.Hosting) > 1 {
+			return nil, fmt.Errorf("Config has several sites, select one of %s", strings.Join(mf.Targets(), ", "))
 		}
+		return mf.Hosting[0], nil
 	}
-	if mf.Hosting != nil {
-		return mf.Hosting.processRedirects(w, r)
+	for _, hosting := range mf.Hosting {
+		if hosting.Target == target || hosting.Site == target {
+			return hosting, nil
+		}
 	}
-	return false, nil
+	if len(mf.Hosting) == 1 && mf.Hosting[0].name() == "" {
+		return mf.Hosting[0], nil
+	}
+	return nil, fmt.Errorf("No hosting config for target %s, available targets: %s", target, strings.Join(mf.Targets(), ", "))
+}
+
+// A ruleset is a FirebaseManifest with all patterns compiled. Rules of a
+// nested `hosting` object are appended to the top-level rules.
+type ruleset struct {
+	dir            string
+	mounts         []mount
+	ignore         []*regexp.Regexp
+	i18nRoot       string
+	appAssociation string
+	cleanURLs      bool
+	trailingSlash  *bool
+	redirects      []redirectRule
+	rewrites       []rewriteRule
+	headers        []headerRule
+	notFoundPages  []rewriteRule
+}
+
+type redirectRule struct {
+	pattern     *regexp.Regexp
+	destination string
+	code        int
+}
+
+type rewriteRule struct {
+	pattern     *regexp.Regexp
+	destination string
+	// backend is `function` or `run` if the rewrite is proxied to a local
+	// backend called name.
+	backend, name string
+}
+
+type headerRule struct {
+	pattern *regexp.Regexp
+	headers [][2]string
 }
 
-func (mf FirebaseManifest) processRewrites(r *http.Request) error {
+// compileSource compiles the `source` extglob or the `regex` of a rule.
+// Regexes use RE2 syntax and have to match the entire path.
+func compileSource(source, regex string) (*regexp.Regexp, error) {
+	if source != "" && regex != "" {
+		return nil, fmt.Errorf("source %s: can’t be combined with regex %s", source, regex)
+	}
+	if regex != "" {
+		pattern, err := regexp.Compile("^(?:" + regex + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("regex %s: %s", regex, err)
+		}
+		return pattern, nil
+	}
+	pattern, err := CompileSourcePattern("/" + strings.TrimPrefix(source, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("extglob %s: %s", source, err)
+	}
+	return pattern, nil
+}
+
+// compileManifest compiles the top-level rules and the rules of the site
+// selected by target.
+func compileManifest(mf FirebaseManifest, target string) (*ruleset, error) {
+	hosting, err := mf.selectSite(target)
+	if err != nil {
+		return nil, err
+	}
+	rs := &ruleset{dir: "."}
+	if err := rs.add(mf); err != nil {
+		return nil, err
+	}
+	if hosting != nil {
+		if err := rs.add(*hosting); err != nil {
+			return nil, err
+		}
+	}
+	return rs, nil
+}
+
+func (rs *ruleset) add(mf FirebaseManifest) error {
+	if mf.Public != "" {
+		rs.dir = mf.Public
+	}
+	for _, glob := range mf.Ignore {
+		pattern, err := CompileExtGlob(strings.TrimPrefix(glob, "/"))
+		if err != nil {
+			return fmt.Errorf("Invalid ignore extglob %s: %s", glob, err)
+		}
+		rs.ignore = append(rs.ignore, pattern)
+	}
+	for prefix, dir := range mf.Mounts {
+		m, err := parseMount(prefix, dir)
+		if err != nil {
+			return err
+		}
+		rs.mounts = append(rs.mounts, m)
+	}
+	rs.cleanURLs = rs.cleanURLs || mf.CleanURLs
+	if mf.AppAssociation != "" {
+		rs.appAssociation = mf.AppAssociation
+	}
+	if mf.I18n != nil {
+		rs.i18nRoot = "/" + strings.Trim(mf.I18n.Root, "/")
+	}
+	if mf.TrailingSlash != nil {
+		rs.trailingSlash = mf.TrailingSlash
+	}
+	for _, redirect := range mf.Redirects {
+		pattern, err := compileSource(redirect.Source, redirect.Regex)
+		if err != nil {
+			return fmt.Errorf("Invalid redirect %s", err)
+		}
+		code := redirect.Type
+		if code == 0 {
+			code = http.StatusMovedPermanently
+		}
+		rs.redirects = append(rs.redirects, redirectRule{pattern, redirect.Destination, code})
+	}
 	for _, rewrite := range mf.Rewrites {
-		pattern, err := CompileExtGlob("/" + strings.TrimPrefix(rewrite.Source, "/"))
+		pattern, err := compileSource(rewrite.Source, rewrite.Regex)
 		if err != nil {
-			return fmt.Errorf("Invalid rewrite extglob %s: %s", rewrite.Source, err)
+			return fmt.Errorf("Invalid rewrite %s", err)
 		}
-		if pattern.MatchString(r.URL.Path) {
-			r.URL.Path = strings.TrimSuffix(rewrite.Destination, "index.html")
-			return nil
+		rule := rewriteRule{pattern: pattern, destination: rewrite.Destination}
+		switch {
+		case rewrite.Function != "":
+			rule.backend, rule.name = "function", string(rewrite.Function)
+		case rewrite.Run != nil:
+			rule.backend, rule.name = "run", rewrite.Run.ServiceID
 		}
+		rs.rewrites = append(rs.rewrites, rule)
 	}
-	if mf.Hosting != nil {
-		return mf.Hosting.processRewrites(r)
+	for _, headerSet := range mf.Headers {
+		pattern, err := compileSource(headerSet.Source, headerSet.Regex)
+		if err != nil {
+			return fmt.Errorf("Invalid hosting.header %s", err)
+		}
+		rule := headerRule{pattern: pattern}
+		for _, header := range headerSet.Headers {
+			rule.headers = append(rule.headers, [2]string{header.Key, header.Value})
+		}
+		rs.headers = append(rs.headers, rule)
+	}
+	for _, page := range mf.NotFoundPages {
+		pattern, err := compileSource(page.Source, page.Regex)
+		if err != nil {
+			return fmt.Errorf("Invalid 404 page %s", err)
+		}
+		rs.notFoundPages = append(rs.notFoundPages, rewriteRule{pattern: pattern, destination: page.Destination})
 	}
 	return nil
 }
 
-func (mf FirebaseManifest) processHeaders(w http.ResponseWriter, r *http.Request) error {
-	for _, headerSet := range mf.Headers {
-		pattern, err := CompileExtGlob("/" + strings.TrimPrefix(headerSet.Source, "/"))
-		if err != nil {
-			return fmt.Errorf("Invalid hosting.header extglob %s: %s", headerSet.Source, err)
+func (rs *ruleset) processRedirects(w http.ResponseWriter, r *http.Request) bool {
+	for _, redirect := range rs.redirects {
+		if match := redirect.pattern.FindStringSubmatch(r.URL.Path); match != nil {
+			redirectPreservingQuery(w, r, ExpandDestination(redirect.destination, redirect.pattern, match), redirect.code)
+			return true
 		}
-		if pattern.MatchString(r.URL.Path) {
-			for _, header := range headerSet.Headers {
-				w.Header().Set(header.Key, header.Value)
+	}
+	return false
+}
+
+// processRewrites rewrites the request path according to the first
+// matching rewrite. If that rewrite targets a local backend, the backend
+// kind and name are returned instead.
+func (rs *ruleset) processRewrites(r *http.Request) (string, string) {
+	for _, rewrite := range rs.rewrites {
+		if match := rewrite.pattern.FindStringSubmatch(r.URL.Path); match != nil {
+			if rewrite.backend != "" {
+				return rewrite.backend, rewrite.name
 			}
+			r.URL.Path = strings.TrimSuffix(ExpandDestination(rewrite.destination, rewrite.pattern, match), "index.html")
+			return "", ""
 		}
 	}
-	if mf.Hosting != nil {
-		return mf.Hosting.processHeaders(w, r)
+	return "", ""
+}
+
+func (rs *ruleset) processHeaders(w http.ResponseWriter, r *http.Request) {
+	for _, headerSet := range rs.headers {
+		if headerSet.pattern.MatchString(r.URL.Path) {
+			for _, header := range headerSet.headers {
+				w.Header().Set(header[0], header[1])
+			}
+		}
 	}
-	return nil
 }
 
-func processWithConfig(w http.ResponseWriter, r *http.Request, config string) (string, bool) {
-	dir := "."
-	mf, err := readManifest(config)
+// notFoundPage returns the 404 page for the given request path.
+func (rs *ruleset) notFoundPage(path string) string {
+	for _, page := range rs.notFoundPages {
+		if match := page.pattern.FindStringSubmatch(path); match != nil {
+			return ExpandDestination(page.destination, page.pattern, match)
+		}
+	}
+	return defaultNotFoundPage
+}
+
+// stat returns the FileInfo of path in the public dir or a mounted dir.
+// Ignored files are treated as absent.
+func (rs *ruleset) stat(path string) (os.FileInfo, error) {
+	f, err := rs.fileSystem().Open(path)
 	if err != nil {
-		log.Printf("Could read Firebase file %s: %s", config, err)
-		return dir, false
+		return nil, err
 	}
-	if mf.Public != "" {
-		dir = mf.Public
+	defer f.Close()
+	return f.Stat()
+}
+
+func (rs *ruleset) isFile(path string) bool {
+	fi, err := rs.stat(path)
+	return err == nil && !fi.IsDir()
+}
+
+func (rs *ruleset) hasIndex(path string) bool {
+	return rs.isFile(path + "/index.html")
+}
+
+// redirectPreservingQuery redirects to target, carrying over the query of
+// the request.
+func redirectPreservingQuery(w http.ResponseWriter, r *http.Request, target string, code int) {
+	http.Redirect(w, r, mergeQuery(target, r.URL.RawQuery), code)
+}
+
+// mergeQuery appends the parameters of rawQuery to the query of target.
+// Parameters the target already has take precedence.
+func mergeQuery(target, rawQuery string) string {
+	if rawQuery == "" {
+		return target
 	}
-	if mf.Hosting != nil && mf.Hosting.Public != "" {
-		dir = mf.Hosting.Public
+	fragment := ""
+	if i := strings.Index(target, "#"); i >= 0 {
+		target, fragment = target[:i], target[i:]
+	}
+	existing := url.Values{}
+	separator := "?"
+	if i := strings.Index(target, "?"); i >= 0 {
+		existing, _ = url.ParseQuery(target[i+1:])
+		separator = "&"
+		if strings.HasSuffix(target, "?") || strings.HasSuffix(target, "&") {
+			separator = ""
+		}
 	}
 
-	done, err := mf.processRedirects(w, r)
-	if err != nil {
-		log.Printf("Processing redirects failed: %s", err)
-		return dir, false
+	params := []string{}
+	for _, param := range strings.Split(rawQuery, "&") {
+		key := strings.SplitN(param, "=", 2)[0]
+		if unescaped, err := url.QueryUnescape(key); err == nil {
+			key = unescaped
+		}
+		if _, ok := existing[key]; param == "" || ok {
+			continue
+		}
+		params = append(params, param)
 	}
-	if done {
-		return dir, true
+	if len(params) == 0 {
+		return target + fragment
 	}
+	return target + separator + strings.Join(params, "&") + fragment
+}
 
-	// Rewrites only happen if the target file does not exist
-	if _, err = os.Stat(filepath.Join(dir, r.URL.Path)); err != nil {
-		err = mf.processRewrites(r)
-		if err != nil {
-			log.Printf("Processing rewrites failed: %s", err)
-			return dir, false
+// processCleanURLs redirects requests for existing `.html` files to their
+// extensionless URL. Requests for `index.html` are redirected to the
+// containing directory.
+func (rs *ruleset) processCleanURLs(w http.ResponseWriter, r *http.Request) bool {
+	if !rs.cleanURLs || !strings.HasSuffix(r.URL.Path, ".html") || !rs.isFile(r.URL.Path) {
+		return false
+	}
+	ts := rs.trailingSlash
+	target := strings.TrimSuffix(r.URL.Path, ".html")
+	switch {
+	case strings.HasSuffix(target, "/index"):
+		target = strings.TrimSuffix(target, "index")
+		if ts != nil && !*ts && target != "/" {
+			target = strings.TrimSuffix(target, "/")
 		}
+	case ts != nil && *ts:
+		target += "/"
 	}
+	redirectPreservingQuery(w, r, target, http.StatusMovedPermanently)
+	return true
+}
 
-	err = mf.processHeaders(w, r)
-	if err != nil {
-		log.Printf("Processing rewrites failed: %s", err)
-		return dir, false
+// processTrailingSlash adds or removes the trailing slash of requests for
+// directory indices and clean URLs, depending on `trailingSlash`.
+// Requests for actual files are never redirected.
+func (rs *ruleset) processTrailingSlash(w http.ResponseWriter, r *http.Request) bool {
+	if r.URL.Path == "/" {
+		return false
+	}
+	slash := strings.HasSuffix(r.URL.Path, "/")
+	base := strings.TrimSuffix(r.URL.Path, "/")
+	if rs.isFile(base) {
+		return false
+	}
+	index := rs.hasIndex(base)
+	if !index && !(rs.cleanURLs && rs.isFile(base+".html")) {
+		return false
+	}
+
+	target := ""
+	switch ts := rs.trailingSlash; {
+	case ts == nil && !slash && index:
+		target = base + "/"
+	case ts == nil && slash && !index:
+		target = base
+	case ts != nil && *ts && !slash:
+		target = base + "/"
+	case ts != nil && !*ts && slash:
+		target = base
 	}
+	if target == "" {
+		return false
+	}
+	redirectPreservingQuery(w, r, target, http.StatusMovedPermanently)
+	return true
+}
+
+// resolveStatic reports whether the request refers to existing content in
+// the public dir. Directories only count if they have an index or -listing
+// is set. Directory indices without a trailing slash and clean URLs are
+// mapped to the path http.FileServer will serve without redirecting.
+func (rs *ruleset) resolveStatic(r *http.Request) bool {
+	if fi, err := rs.stat(r.URL.Path); err == nil {
+		if !fi.IsDir() {
+			return true
+		}
+		index := rs.hasIndex(strings.TrimSuffix(r.URL.Path, "/"))
+		if index && !strings.HasSuffix(r.URL.Path, "/") {
+			r.URL.Path += "/"
+		}
+		if index || *listing {
+			return true
+		}
+	}
+	if !rs.cleanURLs {
+		return false
+	}
+	base := strings.TrimSuffix(r.URL.Path, "/")
+	if base == "" || !rs.isFile(base+".html") {
+		return false
+	}
+	r.URL.Path = base + ".html"
+	return true
+}
+
+// reservedNamespace is reserved by Firebase for its own content. Requests
+// for it are served from the public dir without applying any rules.
+const reservedNamespace = "/__/"
+
+// An outcome tells how a stage of the pipeline handled a request.
+type outcome int
+
+const (
+	// pass leaves the request to the next stage.
+	pass outcome = iota
+	// resolved means the request path refers to the content to serve.
+	resolved
+	// responded means a response has been written.
+	responded
+)
 
-	return dir, false
+// A stage is a step of the pipeline processing a request.
+type stage func(w http.ResponseWriter, r *http.Request) outcome
+
+// pipeline returns the stages in the priority Firebase documents: redirects,
+// exact-match static content and rewrites. Requests that pass every stage
+// get a 404.
+func (rs *ruleset) pipeline() []stage {
+	return []stage{
+		rs.redirectStage,
+		rs.staticStage,
+		rs.rewriteStage,
+	}
+}
+
+// redirectStage applies the configured redirects, followed by the redirects
+// for clean URLs and trailing slashes.
+func (rs *ruleset) redirectStage(w http.ResponseWriter, r *http.Request) outcome {
+	if rs.processRedirects(w, r) || rs.processCleanURLs(w, r) || rs.processTrailingSlash(w, r) {
+		return responded
+	}
+	return pass
+}
+
+// staticStage resolves requests for existing content. Localized content
+// takes precedence.
+func (rs *ruleset) staticStage(w http.ResponseWriter, r *http.Request) outcome {
+	if rs.localize(r) || rs.resolveStatic(r) {
+		return resolved
+	}
+	return pass
+}
+
+// rewriteStage applies the first matching rewrite, which only happens if
+// the requested content does not exist.
+func (rs *ruleset) rewriteStage(w http.ResponseWriter, r *http.Request) outcome {
+	path := r.URL.Path
+	if backend, name := rs.processRewrites(r); backend != "" {
+		serveBackend(w, r, backend, name)
+		return responded
+	}
+	if r.URL.Path == path {
+		return pass
+	}
+	rs.localize(r)
+	return resolved
+}
+
+// process applies the ruleset to the request and reports whether a response
+// has already been written.
+func (rs *ruleset) process(w http.ResponseWriter, r *http.Request) bool {
+	if strings.HasPrefix(r.URL.Path, reservedNamespace) {
+		return false
+	}
+	// Headers are matched against the original path and apply to every
+	// response, including redirects, proxied rewrites and 404s.
+	rs.processHeaders(w, r)
+	for _, stage := range rs.pipeline() {
+		switch stage(w, r) {
+		case responded:
+			return true
+		case resolved:
+			return false
+		}
+	}
+	return false
 }
 
 func readManifest(path string) (FirebaseManifest, error) {
@@ -135,3 +560,11 @@ func readManifest(path string) (FirebaseManifest, error) {
 	err = dec.Decode(&fmf)
 	return fmf, err
 }
+
+func loadRuleset(path, target string) (*ruleset, error) {
+	mf, err := readManifest(path)
+	if err != nil {
+		return nil, err
+	}
+	return compileManifest(mf, target)
+}
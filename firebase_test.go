@@ -0,0 +1,492 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeTestFiles(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "simplehttp2server")
+	if err != nil {
+		t.Fatalf("Couldn’t create temp dir: %s", err)
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Couldn’t create dir for %s: %s", name, err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Couldn’t write %s: %s", name, err)
+		}
+	}
+	return dir
+}
+
+func Test_CleanURLs(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{
+		"about.html":      "about",
+		"docs/index.html": "docs",
+	})
+	defer os.RemoveAll(dir)
+	rs := &ruleset{dir: dir, cleanURLs: true}
+
+	redirects := map[string]string{
+		"/about.html":      "/about",
+		"/about.html?a=b":  "/about?a=b",
+		"/docs/index.html": "/docs/",
+	}
+	for url, location := range redirects {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", url, nil)
+		if !rs.processCleanURLs(w, r) {
+			t.Fatalf("%s wasn’t redirected", url)
+		}
+		if w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != location {
+			t.Fatalf("%s redirected to %d %s, expected 301 %s", url, w.Code, w.Header().Get("Location"), location)
+		}
+	}
+
+	r := httptest.NewRequest("GET", "/missing.html", nil)
+	if rs.processCleanURLs(httptest.NewRecorder(), r) {
+		t.Fatalf("/missing.html was redirected")
+	}
+
+	resolved := map[string]string{
+		"/about":  "/about.html",
+		"/about/": "/about.html",
+		"/docs":   "/docs/",
+	}
+	for url, path := range resolved {
+		r := httptest.NewRequest("GET", url, nil)
+		if !rs.resolveStatic(r) || r.URL.Path != path {
+			t.Fatalf("%s resolved to %s, expected %s", url, r.URL.Path, path)
+		}
+	}
+	r = httptest.NewRequest("GET", "/missing", nil)
+	if rs.resolveStatic(r) {
+		t.Fatalf("/missing resolved to %s", r.URL.Path)
+	}
+}
+
+func Test_RegexSources(t *testing.T) {
+	mf := FirebaseManifest{}
+	if err := json.Unmarshal([]byte(`{
+		"redirects": [{"regex": "/old/(\\d+)/(?P<slug>[a-z-]+)", "destination": "/new/:slug?id=:1", "type": 302}],
+		"rewrites": [{"regex": "/app/.*", "destination": "/app.html"}],
+		"headers": [{"regex": ".*\\.js", "headers": [{"key": "X-Script", "value": "yes"}]}]
+	}`), &mf); err != nil {
+		t.Fatalf("Couldn’t parse manifest: %s", err)
+	}
+	rs, err := compileManifest(mf, "")
+	if err != nil {
+		t.Fatalf("Valid manifest failed to compile: %s", err)
+	}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/old/12/hello-world", nil)
+	if !rs.processRedirects(w, r) {
+		t.Fatalf("Redirect didn’t match")
+	}
+	if location := w.Header().Get("Location"); location != "/new/hello-world?id=12" {
+		t.Fatalf("Redirected to %s", location)
+	}
+	r = httptest.NewRequest("GET", "/old/12/hello-world/more", nil)
+	if rs.processRedirects(httptest.NewRecorder(), r) {
+		t.Fatalf("Regex matched a partial path")
+	}
+
+	r = httptest.NewRequest("GET", "/app/settings", nil)
+	if backend, _ := rs.processRewrites(r); backend != "" || r.URL.Path != "/app.html" {
+		t.Fatalf("Rewrote to %s", r.URL.Path)
+	}
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("GET", "/lib/app.js", nil)
+	if rs.processHeaders(w, r); w.Header().Get("X-Script") != "yes" {
+		t.Fatalf("Header wasn’t applied")
+	}
+
+	mf.Rewrites[0].Regex = "/app/(.*"
+	if _, err := compileManifest(mf, ""); err == nil {
+		t.Fatalf("Invalid regex compiled")
+	}
+	mf.Rewrites[0].Source = "/app/**"
+	mf.Rewrites[0].Regex = "/app/.*"
+	if _, err := compileManifest(mf, ""); err == nil {
+		t.Fatalf("Rule with source and regex compiled")
+	}
+}
+
+func Test_BackendRewrites(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("X-Backend", "api")
+		fmt.Fprintf(w, "%s %s %s", r.Method, r.URL.RequestURI(), body)
+	}))
+	defer backend.Close()
+	proxy, err := newBackendProxy(backend.URL)
+	if err != nil {
+		t.Fatalf("Couldn’t create proxy: %s", err)
+	}
+	localBackends = map[string]http.Handler{"function:api": proxy}
+	defer func() { localBackends = map[string]http.Handler{} }()
+
+	mf := FirebaseManifest{}
+	if err := json.Unmarshal([]byte(`{
+		"rewrites": [
+			{"source": "/api/**", "function": "api"},
+			{"source": "/v2/**", "function": {"functionId": "api", "region": "us-central1"}},
+			{"source": "/svc/**", "run": {"serviceId": "missing"}}
+		]
+	}`), &mf); err != nil {
+		t.Fatalf("Couldn’t parse manifest: %s", err)
+	}
+	rs, err := compileManifest(mf, "")
+	if err != nil {
+		t.Fatalf("Couldn’t compile manifest: %s", err)
+	}
+
+	for _, url := range []string{"/api/items?a=b", "/v2/items?a=b"} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", url, strings.NewReader("body"))
+		if !rs.process(w, r) {
+			t.Fatalf("%s wasn’t proxied", url)
+		}
+		if body := w.Body.String(); body != "POST "+url+" body" || w.Header().Get("X-Backend") != "api" {
+			t.Fatalf("%s got unexpected response %q", url, body)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	if !rs.process(w, httptest.NewRequest("GET", "/svc/x", nil)) || w.Code != http.StatusBadGateway {
+		t.Fatalf("Missing backend returned %d", w.Code)
+	}
+
+	// Like the URL of the Functions emulator.
+	emulator, err := newBackendProxy(backend.URL + "/project/us-central1/api?key=1")
+	if err != nil {
+		t.Fatalf("Couldn’t create proxy: %s", err)
+	}
+	w = httptest.NewRecorder()
+	emulator.ServeHTTP(w, httptest.NewRequest("GET", "/items?a=b", nil))
+	if body := w.Body.String(); body != "GET /project/us-central1/api/items?key=1&a=b " {
+		t.Fatalf("Backend path wasn’t joined, got %q", body)
+	}
+}
+
+func Test_HostingTargets(t *testing.T) {
+	mf := FirebaseManifest{}
+	if err := json.Unmarshal([]byte(`{
+		"redirects": [{"source": "/old", "destination": "/new", "type": 301}],
+		"hosting": [
+			{"target": "app", "public": "app/dist", "cleanUrls": true},
+			{"site": "admin-site", "public": "admin"}
+		]
+	}`), &mf); err != nil {
+		t.Fatalf("Couldn’t parse manifest: %s", err)
+	}
+
+	for target, dir := range map[string]string{"app": "app/dist", "admin-site": "admin"} {
+		rs, err := compileManifest(mf, target)
+		if err != nil {
+			t.Fatalf("Couldn’t compile target %s: %s", target, err)
+		}
+		if rs.dir != dir || len(rs.redirects) != 1 || rs.cleanURLs != (target == "app") {
+			t.Fatalf("Target %s compiled to unexpected ruleset %+v", target, rs)
+		}
+	}
+	if _, err := compileManifest(mf, ""); err == nil {
+		t.Fatalf("Compiled config with several sites without a target")
+	}
+	if _, err := compileManifest(mf, "missing"); err == nil {
+		t.Fatalf("Compiled missing target")
+	}
+
+	mf = FirebaseManifest{}
+	if err := json.Unmarshal([]byte(`{"hosting": {"public": "dist"}}`), &mf); err != nil {
+		t.Fatalf("Couldn’t parse manifest: %s", err)
+	}
+	if rs, err := compileManifest(mf, ""); err != nil || rs.dir != "dist" {
+		t.Fatalf("Single hosting object compiled to %+v: %v", rs, err)
+	}
+}
+
+func Test_Ignore(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{
+		"index.html":                "index",
+		"firebase.json":             "{}",
+		".env":                      "secret",
+		"lib/.cache/x":              "cache",
+		"node_modules/pkg/index.js": "pkg",
+		"lib/node_modules/pkg/a.js": "pkg",
+		"lib/app.js":                "app",
+	})
+	defer os.RemoveAll(dir)
+	mf := FirebaseManifest{
+		Public: dir,
+		Ignore: []string{"firebase.json", "**/.*", "**/node_modules/**"},
+	}
+	if err := json.Unmarshal([]byte(`{"rewrites": [{"source": "**", "destination": "/index.html"}]}`), &mf); err != nil {
+		t.Fatalf("Couldn’t parse manifest: %s", err)
+	}
+	rs, err := compileManifest(mf, "")
+	if err != nil {
+		t.Fatalf("Couldn’t compile manifest: %s", err)
+	}
+
+	for _, path := range []string{"/firebase.json", "/.env", "/lib/.cache/x", "/node_modules/pkg/index.js", "/lib/node_modules/pkg/a.js", "/node_modules"} {
+		if !rs.ignored(path) {
+			t.Fatalf("%s wasn’t ignored", path)
+		}
+		if _, err := rs.fileSystem().Open(path); !os.IsNotExist(err) {
+			t.Fatalf("%s could be opened", path)
+		}
+		r := httptest.NewRequest("GET", path, nil)
+		if rs.process(httptest.NewRecorder(), r); r.URL.Path != "/" {
+			t.Fatalf("%s wasn’t rewritten", path)
+		}
+	}
+	for _, path := range []string{"/index.html", "/lib/app.js", "/lib"} {
+		if rs.ignored(path) {
+			t.Fatalf("%s was ignored", path)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	http.FileServer(rs.fileSystem()).ServeHTTP(w, httptest.NewRequest("GET", "/lib/", nil))
+	if body := w.Body.String(); !strings.Contains(body, "app.js") || strings.Contains(body, "node_modules") || strings.Contains(body, ".cache") {
+		t.Fatalf("Listing contains ignored files: %s", body)
+	}
+}
+
+func Test_I18n(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{
+		"index.html":                               "default",
+		"about.html":                               "about",
+		"app.js":                                   "app",
+		"localized-files/fr_ca/index.html":         "fr_ca",
+		"localized-files/fr_ALL/index.html":        "fr_ALL",
+		"localized-files/fr_ALL/about.html":        "about fr_ALL",
+		"localized-files/es_ALL/app/settings.html": "settings es_ALL",
+		"localized-files/ALL_ca/index.html":        "ALL_ca",
+		"localized-files/ALL_ca/404.html":          "404 ALL_ca",
+	})
+	defer os.RemoveAll(dir)
+	mf := FirebaseManifest{}
+	if err := json.Unmarshal([]byte(`{
+		"cleanUrls": true,
+		"i18n": {"root": "/localized-files"},
+		"rewrites": [{"source": "/app/**", "destination": "/app/settings.html"}]
+	}`), &mf); err != nil {
+		t.Fatalf("Couldn’t parse manifest: %s", err)
+	}
+	mf.Public = dir
+	rs, err := compileManifest(mf, "")
+	if err != nil {
+		t.Fatalf("Couldn’t compile manifest: %s", err)
+	}
+
+	table := []struct {
+		URL, AcceptLanguage, Country, Cookie, Path string
+	}{
+		{"/", "fr-CA, en;q=0.8", "ca", "", "/localized-files/fr_ca/"},
+		{"/", "fr", "", "", "/localized-files/fr_ALL/"},
+		{"/", "de, fr;q=0.5", "de", "", "/localized-files/fr_ALL/"},
+		{"/", "de", "ca", "", "/localized-files/ALL_ca/"},
+		{"/", "de", "", "", "/"},
+		{"/", "de", "", "firebase-language-override=fr", "/localized-files/fr_ALL/"},
+		{"/", "", "us", "firebase-country-override=ca", "/localized-files/ALL_ca/"},
+		{"/about", "fr", "", "", "/localized-files/fr_ALL/about.html"},
+		{"/about", "es", "", "", "/about.html"},
+		{"/app.js", "fr", "", "", "/app.js"},
+		{"/app/profile", "es", "", "", "/localized-files/es_ALL/app/settings.html"},
+	}
+	for _, entry := range table {
+		r := httptest.NewRequest("GET", entry.URL, nil)
+		r.Header.Set("Accept-Language", entry.AcceptLanguage)
+		r.Header.Set(CountryHeader, entry.Country)
+		if entry.Cookie != "" {
+			r.Header.Set("Cookie", entry.Cookie)
+		}
+		if rs.process(httptest.NewRecorder(), r); r.URL.Path != entry.Path {
+			t.Fatalf("%s (%s, %s) resolved to %s, expected %s", entry.URL, entry.AcceptLanguage, entry.Country, r.URL.Path, entry.Path)
+		}
+	}
+
+	r := httptest.NewRequest("GET", "/missing", nil)
+	r.Header.Set(CountryHeader, "CA")
+	if page := rs.localizedFile(r, "/404.html"); page != "/localized-files/ALL_ca/404.html" {
+		t.Fatalf("404 page resolved to %s", page)
+	}
+}
+
+func Test_TrailingSlash(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{
+		"index.html":      "index",
+		"about.html":      "about",
+		"app.js":          "app",
+		"docs/index.html": "docs",
+	})
+	defer os.RemoveAll(dir)
+	yes, no := true, false
+
+	table := []struct {
+		TrailingSlash *bool
+		URL           string
+		Location      string
+	}{
+		{nil, "/docs", "/docs/"},
+		{nil, "/docs/", ""},
+		{nil, "/about", ""},
+		{nil, "/about/", "/about"},
+		{nil, "/about.html", "/about"},
+		{nil, "/docs/index.html", "/docs/"},
+		{&yes, "/docs", "/docs/"},
+		{&yes, "/about", "/about/"},
+		{&yes, "/about/", ""},
+		{&yes, "/about.html", "/about/"},
+		{&yes, "/app.js", ""},
+		{&no, "/docs", ""},
+		{&no, "/docs/", "/docs"},
+		{&no, "/about/", "/about"},
+		{&no, "/docs/index.html", "/docs"},
+		{&no, "/index.html", "/"},
+		{&no, "/", ""},
+	}
+	for _, entry := range table {
+		rs := &ruleset{dir: dir, cleanURLs: true, trailingSlash: entry.TrailingSlash}
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", entry.URL, nil)
+		redirected := rs.processCleanURLs(w, r) || rs.processTrailingSlash(w, r)
+		if location := w.Header().Get("Location"); redirected != (entry.Location != "") || location != entry.Location {
+			t.Fatalf("%s (trailingSlash %v) redirected to %q, expected %q", entry.URL, entry.TrailingSlash, location, entry.Location)
+		}
+	}
+}
+
+func Test_ConfigReload(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{
+		"firebase.json": `{"redirects": [{"source": "/a", "destination": "/b", "type": 301}]}`,
+	})
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "firebase.json")
+	cw, err := newConfigWatcher(path, "", "")
+	if err != nil {
+		t.Fatalf("Couldn’t load config: %s", err)
+	}
+	rs := cw.Ruleset()
+
+	ioutil.WriteFile(path, []byte(`{"redirects": [{"source": "/a/@(", "destination": "/b"}]}`), 0644)
+	cw.reload()
+	if cw.Ruleset() != rs {
+		t.Fatalf("Invalid config replaced the ruleset")
+	}
+
+	ioutil.WriteFile(path, []byte(`{"cleanUrls": true}`), 0644)
+	cw.reload()
+	if cw.Ruleset() == rs || !cw.Ruleset().cleanURLs {
+		t.Fatalf("Valid config didn’t replace the ruleset")
+	}
+}
+
+func Test_RedirectQuery(t *testing.T) {
+	mf := FirebaseManifest{}
+	if err := json.Unmarshal([]byte(`{
+		"redirects": [
+			{"source": "/old/:splat*", "destination": "/new/:splat"},
+			{"source": "/blog/:post*", "destination": "https://blog.myapp.com/:post*"},
+			{"source": "/campaign", "destination": "https://example.com/landing?utm_source=site#top", "type": 302}
+		]
+	}`), &mf); err != nil {
+		t.Fatalf("Couldn’t parse manifest: %s", err)
+	}
+	rs, err := compileManifest(mf, "")
+	if err != nil {
+		t.Fatalf("Couldn’t compile manifest: %s", err)
+	}
+
+	table := []struct {
+		URL, Location string
+		Code          int
+	}{
+		{"/old/a/b", "/new/a/b", 301},
+		{"/old/a?utm_source=mail&utm_medium=link", "/new/a?utm_source=mail&utm_medium=link", 301},
+		{"/blog/2017/hello?ref=feed", "https://blog.myapp.com/2017/hello?ref=feed", 301},
+		{"/campaign", "https://example.com/landing?utm_source=site#top", 302},
+		{"/campaign?utm_source=mail&utm_campaign=fall%20sale", "https://example.com/landing?utm_source=site&utm_campaign=fall%20sale#top", 302},
+	}
+	for _, entry := range table {
+		w := httptest.NewRecorder()
+		if !rs.processRedirects(w, httptest.NewRequest("GET", entry.URL, nil)) {
+			t.Fatalf("%s wasn’t redirected", entry.URL)
+		}
+		if location := w.Header().Get("Location"); location != entry.Location || w.Code != entry.Code {
+			t.Fatalf("%s was redirected to %s with %d, expected %s with %d", entry.URL, location, w.Code, entry.Location, entry.Code)
+		}
+	}
+}
+
+func Test_Mounts(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{
+		"dist/index.html":               "index",
+		"dist/firebase.json":            "{}",
+		"dist/.env":                     "SECRET=1",
+		"dist/node_modules/lib.js":      "shadowed",
+		"node_modules/lib/lib.js":       "lib",
+		"node_modules/lib/package.json": "{}",
+		"vendor/lib.js":                 "vendor",
+	})
+	defer os.RemoveAll(dir)
+	mf := FirebaseManifest{}
+	if err := json.Unmarshal([]byte(`{
+		"public": "`+filepath.ToSlash(filepath.Join(dir, "dist"))+`",
+		"ignore": ["firebase.json", "**/.*", "**/node_modules/**"],
+		"mounts": {"/node_modules": "`+filepath.ToSlash(filepath.Join(dir, "node_modules"))+`"}
+	}`), &mf); err != nil {
+		t.Fatalf("Couldn’t parse manifest: %s", err)
+	}
+	mountsFlag = mountList{{"/node_modules/lib/vendor", filepath.Join(dir, "vendor")}}
+	defer func() { mountsFlag = nil }()
+	rs, err := compileManifest(mf, "")
+	if err != nil {
+		t.Fatalf("Couldn’t compile manifest: %s", err)
+	}
+
+	table := map[string]string{
+		"/index.html":                     "index",
+		"/node_modules/lib/lib.js":        "lib",
+		"/node_modules/lib/vendor/lib.js": "vendor",
+		"/node_modules/lib/package.json":  "{}",
+		"/node_modules/lib.js":            "",
+		"/firebase.json":                  "",
+		"/.env":                           "",
+	}
+	for path, content := range table {
+		f, err := rs.fileSystem().Open(path)
+		if content == "" {
+			if err == nil {
+				t.Fatalf("%s was served", path)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Couldn’t open %s: %s", path, err)
+		}
+		data, _ := ioutil.ReadAll(f)
+		f.Close()
+		if string(data) != content {
+			t.Fatalf("%s served %q, expected %q", path, data, content)
+		}
+	}
+
+	if err := mountsFlag.Set("node_modules=./node_modules"); err == nil {
+		t.Fatalf("Mount point without leading slash was accepted")
+	}
+}
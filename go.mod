@@ -0,0 +1,15 @@
+module github.com/GoogleChrome/simplehttp2server
+
+go 1.22
+
+require (
+	github.com/andybalholm/brotli v1.2.0
+	github.com/klauspost/compress v1.18.0
+	golang.org/x/net v0.35.0
+	software.sslmate.com/src/go-pkcs12 v0.5.0
+)
+
+require (
+	golang.org/x/crypto v0.33.0 // indirect
+	golang.org/x/text v0.22.0 // indirect
+)
@@ -10,6 +10,8 @@ import (
 // plaintext and emits a HTTP 301 redirect if appropriate.
 type HijackHTTPListener struct {
 	net.Listener
+	// Host is the address clients are redirected to.
+	Host string
 }
 
 type Conn struct {
@@ -64,7 +66,7 @@ func (l *HijackHTTPListener) Accept() (net.Conn, error) {
 	}
 
 	// Otherwise it’s HTTP
-	con.Write([]byte(fmt.Sprintf("HTTP/1.1 301 Moved Permanently\nLocation: https://%s/\n", *listen)))
+	con.Write([]byte(fmt.Sprintf("HTTP/1.1 301 Moved Permanently\nLocation: https://%s/\n", l.Host)))
 	con.Close()
 	return con, nil
 }
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// CountryHeader overrides the country of a request, as there is no
+	// geolocation of the client.
+	CountryHeader = "X-Country-Code"
+)
+
+// requestLanguages returns the primary language subtags of the request in
+// order of preference. The `firebase-language-override` cookie takes
+// precedence over the Accept-Language header.
+func requestLanguages(r *http.Request) []string {
+	type language struct {
+		tag string
+		q   float64
+	}
+	languages := []language{}
+	if c, err := r.Cookie("firebase-language-override"); err == nil {
+		for _, tag := range strings.Split(c.Value, ",") {
+			languages = append(languages, language{tag, 1})
+		}
+	} else {
+		for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+			fields := strings.Split(part, ";")
+			lang := language{strings.TrimSpace(fields[0]), 1}
+			for _, param := range fields[1:] {
+				param = strings.TrimSpace(param)
+				if strings.HasPrefix(param, "q=") {
+					if q, err := strconv.ParseFloat(param[2:], 64); err == nil {
+						lang.q = q
+					}
+				}
+			}
+			languages = append(languages, lang)
+		}
+		sort.SliceStable(languages, func(i, j int) bool {
+			return languages[i].q > languages[j].q
+		})
+	}
+
+	tags := []string{}
+	for _, lang := range languages {
+		tag := strings.ToLower(strings.TrimSpace(lang.tag))
+		if i := strings.IndexAny(tag, "-_"); i >= 0 {
+			tag = tag[:i]
+		}
+		if tag != "" && tag != "*" && lang.q > 0 && !contains(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// requestCountry returns the country of the request from the
+// `firebase-country-override` cookie, the CountryHeader or the `-country`
+// flag, in that order.
+func requestCountry(r *http.Request) string {
+	if c, err := r.Cookie("firebase-country-override"); err == nil && c.Value != "" {
+		return strings.ToLower(c.Value)
+	}
+	if h := r.Header.Get(CountryHeader); h != "" {
+		return strings.ToLower(h)
+	}
+	return strings.ToLower(*country)
+}
+
+// localeFolders returns the folders of the i18n root that are searched for
+// localized content, in the order Firebase searches them: language and
+// country, language only and country only.
+func localeFolders(r *http.Request) []string {
+	languages := requestLanguages(r)
+	country := requestCountry(r)
+	folders := []string{}
+	if country != "" {
+		for _, lang := range languages {
+			folders = append(folders, lang+"_"+country)
+		}
+	}
+	for _, lang := range languages {
+		folders = append(folders, lang+"_ALL")
+	}
+	if country != "" {
+		folders = append(folders, "ALL_"+country)
+	}
+	return folders
+}
+
+// localize maps the request path to localized content in the i18n root, if
+// there is any for the request’s languages and country.
+func (rs *ruleset) localize(r *http.Request) bool {
+	if rs.i18nRoot == "" {
+		return false
+	}
+	path := r.URL.Path
+	for _, folder := range localeFolders(r) {
+		r.URL.Path = rs.i18nRoot + "/" + folder + path
+		if !rs.resolveStatic(r) {
+			continue
+		}
+		if strings.HasSuffix(r.URL.Path, "/") && rs.hasIndex(strings.TrimSuffix(r.URL.Path, "/")) || rs.isFile(r.URL.Path) {
+			return true
+		}
+	}
+	r.URL.Path = path
+	return false
+}
+
+// localizedFile returns the path of the localized variant of a file, or
+// the path itself if there is none.
+func (rs *ruleset) localizedFile(r *http.Request, path string) string {
+	if rs.i18nRoot == "" {
+		return path
+	}
+	for _, folder := range localeFolders(r) {
+		if localized := rs.i18nRoot + "/" + folder + path; rs.isFile(localized) {
+			return localized
+		}
+	}
+	return path
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// ignored reports whether a path in the public dir matches one of the
+// `ignore` extglobs. A path is also ignored if one of its parent
+// directories is.
+func (rs *ruleset) ignored(name string) bool {
+	if len(rs.ignore) == 0 {
+		return false
+	}
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	for name != "" && name != "." {
+		for _, pattern := range rs.ignore {
+			if pattern.MatchString(name) {
+				return true
+			}
+		}
+		name = path.Dir(name)
+	}
+	return false
+}
+
+// fileSystem returns the public dir and the mounted dirs as an
+// http.FileSystem. Ignored files of the public dir are hidden, both from
+// direct requests and from directory listings. The ignore globs don’t apply
+// to mounted dirs, so the default `**/node_modules/**` doesn’t hide a
+// `/node_modules` mount. Mounts given on the command line take precedence
+// over the ones of the config.
+func (rs *ruleset) fileSystem() http.FileSystem {
+	mounts := append(append([]mount{}, rs.mounts...), mountsFlag...)
+	return newMountFS(ignoreFS{http.Dir(rs.dir), rs}, mounts)
+}
+
+type ignoreFS struct {
+	fs http.FileSystem
+	rs *ruleset
+}
+
+func (ifs ignoreFS) Open(name string) (http.File, error) {
+	if ifs.rs.ignored(name) {
+		return nil, os.ErrNotExist
+	}
+	f, err := ifs.fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return ignoreFile{f, name, ifs.rs}, nil
+}
+
+type ignoreFile struct {
+	http.File
+	name string
+	rs   *ruleset
+}
+
+func (f ignoreFile) Readdir(count int) ([]os.FileInfo, error) {
+	fis, err := f.File.Readdir(count)
+	filtered := fis[:0]
+	for _, fi := range fis {
+		if !f.rs.ignored(path.Join(f.name, fi.Name())) {
+			filtered = append(filtered, fi)
+		}
+	}
+	return filtered, err
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A listingEntry is a file or directory in a directory listing.
+type listingEntry struct {
+	Name     string    `json:"name"`
+	Path     string    `json:"path"`
+	Dir      bool      `json:"dir"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+}
+
+type breadcrumb struct {
+	Name, Path string
+}
+
+// A dirListing is the listing of a directory, sorted by a column.
+type dirListing struct {
+	Path    string         `json:"path"`
+	Sort    string         `json:"sort"`
+	Order   string         `json:"order"`
+	Entries []listingEntry `json:"entries"`
+}
+
+// Breadcrumbs returns the parent directories of the listing, starting with
+// the root.
+func (l dirListing) Breadcrumbs() []breadcrumb {
+	crumbs := []breadcrumb{{"/", "/"}}
+	current := "/"
+	for _, name := range strings.Split(strings.Trim(l.Path, "/"), "/") {
+		if name == "" {
+			continue
+		}
+		current += name + "/"
+		crumbs = append(crumbs, breadcrumb{name, current})
+	}
+	return crumbs
+}
+
+// SortLink returns the query that sorts the listing by column, reversing
+// the order if it is already sorted by it.
+func (l dirListing) SortLink(column string) string {
+	order := "asc"
+	if l.Sort == column && l.Order == "asc" {
+		order = "desc"
+	}
+	return "?sort=" + column + "&order=" + order
+}
+
+// sortEntries sorts directories first, then by column. Unknown columns sort
+// by name.
+func sortEntries(entries []listingEntry, column, order string) {
+	less := func(a, b listingEntry) bool {
+		switch column {
+		case "size":
+			if a.Size != b.Size {
+				return a.Size < b.Size
+			}
+		case "modified":
+			if !a.Modified.Equal(b.Modified) {
+				return a.Modified.Before(b.Modified)
+			}
+		}
+		return a.Name < b.Name
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if a.Dir != b.Dir {
+			return a.Dir
+		}
+		if order == "desc" {
+			return less(b, a)
+		}
+		return less(a, b)
+	})
+}
+
+// listingHandler serves a listing for directories without an index.html,
+// as HTML or as JSON if the client accepts it. All other requests go to h.
+func listingHandler(h http.Handler, fs http.FileSystem) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := path.Clean("/" + r.URL.Path)
+		f, err := fs.Open(name)
+		if err != nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+		defer f.Close()
+		fi, err := f.Stat()
+		if err != nil || !fi.IsDir() {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if index, err := fs.Open(path.Join(name, "index.html")); err == nil {
+			index.Close()
+			h.ServeHTTP(w, r)
+			return
+		}
+		if !strings.HasSuffix(r.URL.Path, "/") {
+			redirectPreservingQuery(w, r, r.URL.Path+"/", http.StatusMovedPermanently)
+			return
+		}
+
+		fis, err := f.Readdir(-1)
+		if err != nil {
+			log.Printf("Error reading directory %s: %s", name, err)
+			http.Error(w, "Error reading directory", http.StatusInternalServerError)
+			return
+		}
+		l := dirListing{
+			Path:    strings.TrimSuffix(name, "/") + "/",
+			Sort:    r.URL.Query().Get("sort"),
+			Order:   r.URL.Query().Get("order"),
+			Entries: []listingEntry{},
+		}
+		if l.Sort == "" {
+			l.Sort = "name"
+		}
+		if l.Order != "desc" {
+			l.Order = "asc"
+		}
+		for _, fi := range fis {
+			entry := listingEntry{Name: fi.Name(), Path: l.Path + url.PathEscape(fi.Name()), Dir: fi.IsDir(), Modified: fi.ModTime().UTC()}
+			if entry.Dir {
+				entry.Path += "/"
+			} else {
+				entry.Size = fi.Size()
+			}
+			l.Entries = append(l.Entries, entry)
+		}
+		sortEntries(l.Entries, l.Sort, l.Order)
+
+		if strings.Contains(r.Header.Get("Accept"), "application/json") {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(l)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := listingTemplate.Execute(w, l); err != nil {
+			log.Printf("Error rendering listing of %s: %s", name, err)
+		}
+	})
+}
+
+// formatSize formats a file size with binary units.
+func formatSize(size int64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	value, unit := float64(size), 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+	if unit == 0 {
+		return strconv.FormatInt(size, 10) + " B"
+	}
+	return strconv.FormatFloat(value, 'f', 1, 64) + " " + units[unit]
+}
+
+var listingTemplate = template.Must(template.New("listing").Funcs(template.FuncMap{
+	"size": formatSize,
+	"time": func(t time.Time) string { return t.Format("2006-01-02 15:04:05") },
+}).Parse(`<!doctype html>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Index of {{.Path}}</title>
+<style>
+  body { font-family: system-ui, sans-serif; margin: 2em auto; max-width: 60em; padding: 0 1em; color: #202124; }
+  h1 { font-size: 1.25em; font-weight: normal; }
+  h1 a { color: #1a73e8; text-decoration: none; }
+  table { border-collapse: collapse; width: 100%; }
+  th, td { padding: .4em .8em; text-align: left; border-bottom: 1px solid #e8eaed; }
+  th a { color: inherit; }
+  td.size, th.size { text-align: right; }
+  tr:hover td { background: #f1f3f4; }
+  td a { color: #1a73e8; text-decoration: none; }
+  td.dir a { font-weight: bold; }
+</style>
+<h1>Index of {{range .Breadcrumbs}}<a href="{{.Path}}">{{.Name}}</a>{{if ne .Name "/"}}/{{end}}{{end}}</h1>
+<table>
+  <tr>
+    <th><a href="{{.SortLink "name"}}">Name</a></th>
+    <th class="size"><a href="{{.SortLink "size"}}">Size</a></th>
+    <th><a href="{{.SortLink "modified"}}">Modified</a></th>
+  </tr>
+  {{if ne .Path "/"}}<tr><td class="dir"><a href="../">../</a></td><td></td><td></td></tr>{{end}}
+  {{range .Entries}}<tr>
+    <td{{if .Dir}} class="dir"{{end}}><a href="{{.Path}}">{{.Name}}{{if .Dir}}/{{end}}</a></td>
+    <td class="size">{{if not .Dir}}{{size .Size}}{{end}}</td>
+    <td>{{time .Modified}}</td>
+  </tr>
+  {{end}}
+</table>
+`))
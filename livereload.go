@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	liveReloadEvents = reservedNamespace + "livereload"
+	liveReloadScript = reservedNamespace + "livereload.js"
+)
+
+// A liveReload watches the dirs of a site and sends the URL paths of changed
+// files to the connected clients as Server-Sent Events.
+type liveReload struct {
+	mu      sync.Mutex
+	clients map[chan []string]bool
+}
+
+// newLiveReload starts watching the public dir returned by publicDir. As
+// the dir can change when the config is reloaded, publicDir is called for
+// every scan.
+func newLiveReload(publicDir func() (string, func(string) bool)) *liveReload {
+	lr := &liveReload{clients: map[chan []string]bool{}}
+	go lr.watch(publicDir)
+	return lr
+}
+
+func (lr *liveReload) watch(publicDir func() (string, func(string) bool)) {
+	last := scanDir(publicDir())
+	for range time.Tick(watchInterval) {
+		current := scanDir(publicDir())
+		changed := []string{}
+		for name, stamp := range current {
+			if last[name] != stamp {
+				changed = append(changed, name)
+			}
+		}
+		for name := range last {
+			if _, ok := current[name]; !ok {
+				changed = append(changed, name)
+			}
+		}
+		last = current
+		if len(changed) > 0 {
+			sort.Strings(changed)
+			lr.broadcast(changed)
+		}
+	}
+}
+
+// scanDir returns the modification time and size of every file in the
+// public dir by URL path. Hidden files, ignored files and node_modules are
+// skipped, as walking them every watchInterval is too expensive. Mounted
+// dirs aren’t scanned for the same reason.
+func scanDir(dir string, ignored func(string) bool) map[string]string {
+	stamps := map[string]string{}
+	filepath.Walk(dir, func(name string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, name)
+		if err != nil {
+			return nil
+		}
+		urlPath := path.Join("/", filepath.ToSlash(rel))
+		if rel != "." && (strings.HasPrefix(fi.Name(), ".") || fi.Name() == "node_modules" || ignored(urlPath)) {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !fi.IsDir() {
+			stamps[urlPath] = fmt.Sprintf("%s/%d", fi.ModTime(), fi.Size())
+		}
+		return nil
+	})
+	return stamps
+}
+
+func (lr *liveReload) broadcast(changed []string) {
+	log.Printf("Live reload: %s changed", strings.Join(changed, ", "))
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+	for client := range lr.clients {
+		select {
+		case client <- changed:
+		default:
+		}
+	}
+}
+
+// ServeHTTP serves the client script and the event stream.
+func (lr *liveReload) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == liveReloadScript {
+		w.Header().Set("Content-Type", "application/javascript")
+		w.Header().Set("Cache-Control", "no-cache")
+		fmt.Fprint(w, liveReloadClient)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	// The stream outlives the write timeout of the server.
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	client := make(chan []string, 16)
+	lr.mu.Lock()
+	lr.clients[client] = true
+	lr.mu.Unlock()
+	defer func() {
+		lr.mu.Lock()
+		delete(lr.clients, client)
+		lr.mu.Unlock()
+	}()
+
+	keepAlive := time.NewTicker(30 * time.Second)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case changed := <-client:
+			data, _ := json.Marshal(changed)
+			fmt.Fprintf(w, "event: change\ndata: %s\n\n", data)
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// liveReloadInjector appends the client script to HTML responses. As the
+// length of the response changes, Content-Length is removed.
+type liveReloadInjector struct {
+	http.ResponseWriter
+	wroteHeader, inject bool
+}
+
+func (li *liveReloadInjector) WriteHeader(code int) {
+	if li.wroteHeader {
+		return
+	}
+	li.wroteHeader = true
+	if code != http.StatusPartialContent && strings.HasPrefix(li.Header().Get("Content-Type"), "text/html") {
+		li.inject = true
+		li.Header().Del("Content-Length")
+	}
+	li.ResponseWriter.WriteHeader(code)
+}
+
+func (li *liveReloadInjector) Write(b []byte) (int, error) {
+	if !li.wroteHeader {
+		if li.Header().Get("Content-Type") == "" {
+			li.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		li.WriteHeader(http.StatusOK)
+	}
+	return li.ResponseWriter.Write(b)
+}
+
+// injectLiveReload wraps h to add the live reload client to HTML responses.
+func injectLiveReload(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		li := &liveReloadInjector{ResponseWriter: w}
+		h.ServeHTTP(li, r)
+		if li.inject && r.Method != "HEAD" {
+			fmt.Fprintf(w, "\n<script src=%q></script>\n", liveReloadScript)
+		}
+	})
+}
+
+// liveReloadClient reloads the page when files change. If only stylesheets
+// changed, they are swapped without reloading.
+const liveReloadClient = `(function() {
+  var source = new EventSource('` + liveReloadEvents + `');
+  source.addEventListener('change', function(event) {
+    var changed = JSON.parse(event.data);
+    var onlyCSS = changed.every(function(path) { return /\.css$/.test(path); });
+    if (!onlyCSS) {
+      location.reload();
+      return;
+    }
+    var links = document.querySelectorAll('link[rel="stylesheet"]');
+    Array.prototype.forEach.call(links, function(link) {
+      var url = new URL(link.href);
+      if (url.origin !== location.origin) {
+        return;
+      }
+      url.searchParams.set('livereload', Date.now());
+      var swapped = link.cloneNode();
+      swapped.href = url.href;
+      swapped.onload = swapped.onerror = function() {
+        link.remove();
+      };
+      link.parentNode.insertBefore(swapped, link.nextSibling);
+    });
+  });
+})();
+`
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// A mount serves dir under a URL prefix.
+type mount struct {
+	prefix, dir string
+}
+
+func parseMount(prefix, dir string) (mount, error) {
+	if !strings.HasPrefix(prefix, "/") {
+		return mount{}, fmt.Errorf("Invalid mount point %s, must start with /", prefix)
+	}
+	if dir == "" {
+		return mount{}, fmt.Errorf("Invalid mount point %s, no directory given", prefix)
+	}
+	return mount{path.Clean(prefix), dir}, nil
+}
+
+// rebase resolves the relative dirs of the ruleset against base.
+func (rs *ruleset) rebase(base string) {
+	if !filepath.IsAbs(rs.dir) {
+		rs.dir = filepath.Join(base, rs.dir)
+	}
+	for i, m := range rs.mounts {
+		if !filepath.IsAbs(m.dir) {
+			rs.mounts[i].dir = filepath.Join(base, m.dir)
+		}
+	}
+}
+
+// mountList is the value of the repeatable `-mount` flag.
+type mountList []mount
+
+func (ml *mountList) String() string {
+	entries := []string{}
+	for _, m := range *ml {
+		entries = append(entries, m.prefix+"="+m.dir)
+	}
+	return strings.Join(entries, ",")
+}
+
+func (ml *mountList) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("Invalid mount %q, expected prefix=path", value)
+	}
+	m, err := parseMount(parts[0], parts[1])
+	if err != nil {
+		return err
+	}
+	*ml = append(*ml, m)
+	return nil
+}
+
+// mountFS serves the root file system with dirs mounted at URL prefixes.
+// The longest matching prefix wins. Of mounts with the same prefix, the last
+// one wins.
+type mountFS struct {
+	root   http.FileSystem
+	mounts []mount
+}
+
+func newMountFS(root http.FileSystem, mounts []mount) mountFS {
+	sorted := append([]mount{}, mounts...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return len(sorted[i].prefix) > len(sorted[j].prefix)
+	})
+	deduped := []mount{}
+	for i, m := range sorted {
+		if i+1 < len(sorted) && sorted[i+1].prefix == m.prefix {
+			continue
+		}
+		deduped = append(deduped, m)
+	}
+	return mountFS{root, deduped}
+}
+
+func (mfs mountFS) Open(name string) (http.File, error) {
+	name = path.Clean("/" + name)
+	for _, m := range mfs.mounts {
+		if rest, ok := cutPrefix(name, m.prefix); ok {
+			return http.Dir(m.dir).Open("/" + rest)
+		}
+	}
+	return mfs.root.Open(name)
+}
+
+// cutPrefix returns the rest of name if it is prefix itself or inside of
+// it.
+func cutPrefix(name, prefix string) (string, bool) {
+	if prefix == "/" {
+		return strings.TrimPrefix(name, "/"), true
+	}
+	if name == prefix {
+		return "", true
+	}
+	if strings.HasPrefix(name, prefix+"/") {
+		return name[len(prefix)+1:], true
+	}
+	return "", false
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"path"
+)
+
+const (
+	defaultNotFoundPage = "/404.html"
+)
+
+// notFoundInterceptor swallows a 404 response so that a custom 404 page
+// can be served instead.
+type notFoundInterceptor struct {
+	http.ResponseWriter
+	notFound bool
+}
+
+func (nf *notFoundInterceptor) WriteHeader(code int) {
+	if code == http.StatusNotFound {
+		nf.notFound = true
+		return
+	}
+	nf.ResponseWriter.WriteHeader(code)
+}
+
+func (nf *notFoundInterceptor) Write(b []byte) (int, error) {
+	if nf.notFound {
+		return len(b), nil
+	}
+	return nf.ResponseWriter.Write(b)
+}
+
+// notFoundHandler serves page from fs with a 404 status whenever h
+// responds with a 404. If page doesn’t exist either, the plain 404 of h is
+// sent. Headers set before h ran, like configured headers, are kept.
+func notFoundHandler(h http.Handler, fs http.FileSystem, page string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := w.Header().Clone()
+		nf := &notFoundInterceptor{ResponseWriter: w}
+		h.ServeHTTP(nf, r)
+		if !nf.notFound {
+			return
+		}
+
+		// http.FileServer drops headers like Cache-Control from errors.
+		for key := range w.Header() {
+			delete(w.Header(), key)
+		}
+		for key, values := range header {
+			w.Header()[key] = values
+		}
+
+		f, err := fs.Open(page)
+		if err != nil {
+			http.Error(w, "404 page not found", http.StatusNotFound)
+			return
+		}
+		defer f.Close()
+		log.Printf("--> Not found, serving %s", page)
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusNotFound)
+		if r.Method != "HEAD" {
+			io.Copy(w, f)
+		}
+	})
+}
+
+// indexlessDirHandler responds with a 404 to requests for directories
+// without an index.html, as Firebase does, instead of the listing of
+// http.FileServer. All other requests go to h.
+func indexlessDirHandler(h http.Handler, fs http.FileSystem) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := path.Clean("/" + r.URL.Path)
+		f, err := fs.Open(name)
+		if err != nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+		fi, err := f.Stat()
+		f.Close()
+		if err != nil || !fi.IsDir() {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if index, err := fs.Open(path.Join(name, "index.html")); err == nil {
+			index.Close()
+			h.ServeHTTP(w, r)
+			return
+		}
+		http.NotFound(w, r)
+	})
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"testing"
+)
+
+func Test_NotFoundHandler(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{
+		"index.html":     "index",
+		"404.html":       "custom 404",
+		"app/404.html":   "app 404",
+		"app/index.html": "app",
+	})
+	defer os.RemoveAll(dir)
+	rs := &ruleset{dir: dir}
+	rs.notFoundPages = append(rs.notFoundPages, rewriteRule{pattern: mustCompileSource(t, "/app/**"), destination: "/app/404.html"})
+	c, err := newCompressor("gzip", "text/*", 0)
+	if err != nil {
+		t.Fatalf("Couldn’t create compressor: %s", err)
+	}
+
+	table := []struct {
+		URL  string
+		Code int
+		Body string
+	}{
+		{"/", http.StatusOK, "index"},
+		{"/missing", http.StatusNotFound, "custom 404"},
+		{"/app/missing", http.StatusNotFound, "app 404"},
+	}
+	for _, entry := range table {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", entry.URL, nil)
+		r.Header.Set("Accept-Encoding", "gzip")
+		h := c.Handler(notFoundHandler(http.FileServer(http.Dir(dir)), http.Dir(dir), rs.notFoundPage(entry.URL)))
+		h.ServeHTTP(w, r)
+
+		if w.Header().Get("Content-Encoding") != "gzip" {
+			t.Fatalf("%s wasn’t compressed", entry.URL)
+		}
+		gz, err := gzip.NewReader(w.Body)
+		if err != nil {
+			t.Fatalf("%s: invalid gzip response: %s", entry.URL, err)
+		}
+		b, _ := ioutil.ReadAll(gz)
+		body := string(b)
+		if w.Code != entry.Code || body != entry.Body {
+			t.Fatalf("%s returned %d %q, expected %d %q", entry.URL, w.Code, body, entry.Code, entry.Body)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	notFoundHandler(http.FileServer(http.Dir(dir)), http.Dir(dir), "/none.html").ServeHTTP(w, httptest.NewRequest("GET", "/missing", nil))
+	if w.Code != http.StatusNotFound || w.Body.String() != "404 page not found\n" {
+		t.Fatalf("Missing 404 page returned %d %q", w.Code, w.Body.String())
+	}
+}
+
+func mustCompileSource(t *testing.T, source string) *regexp.Regexp {
+	pattern, err := compileSource(source, "")
+	if err != nil {
+		t.Fatalf("Couldn’t compile %s: %s", source, err)
+	}
+	return pattern
+}
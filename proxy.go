@@ -0,0 +1,130 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// A backendConfig maps the `function` and `run.serviceId` targets of
+// rewrites to local URLs. URLs with the scheme `h2c` are proxied using
+// HTTP/2 over cleartext, all others using HTTP/1.1.
+type backendConfig struct {
+	Functions map[string]string `json:"functions"`
+	Run       map[string]string `json:"run"`
+}
+
+// localBackends holds a reverse proxy for every configured backend, keyed
+// by `function:<name>` or `run:<serviceId>`.
+var localBackends = map[string]http.Handler{}
+
+// rewriteFunction is the `function` of a rewrite, which Firebase allows to
+// be either the function name or an object with a `functionId`.
+type rewriteFunction string
+
+func (f *rewriteFunction) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err == nil {
+		*f = rewriteFunction(name)
+		return nil
+	}
+	var obj struct {
+		FunctionID string `json:"functionId"`
+	}
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return err
+	}
+	*f = rewriteFunction(obj.FunctionID)
+	return nil
+}
+
+func readBackends(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	bc := backendConfig{}
+	if err := json.NewDecoder(f).Decode(&bc); err != nil {
+		return err
+	}
+
+	backends := map[string]http.Handler{}
+	for kind, targets := range map[string]map[string]string{"function": bc.Functions, "run": bc.Run} {
+		for name, target := range targets {
+			proxy, err := newBackendProxy(target)
+			if err != nil {
+				return fmt.Errorf("Invalid backend for %s %s: %s", kind, name, err)
+			}
+			backends[kind+":"+name] = proxy
+		}
+	}
+	localBackends = backends
+	return nil
+}
+
+func newBackendProxy(target string) (http.Handler, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("%s has no host", target)
+	}
+
+	var transport http.RoundTripper = http.DefaultTransport
+	switch u.Scheme {
+	case "http":
+	case "h2c":
+		u.Scheme = "http"
+		transport = &http2.Transport{
+			AllowHTTP: true,
+			DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+				return net.Dial(network, addr)
+			},
+		}
+	default:
+		return nil, fmt.Errorf("unsupported scheme %s", u.Scheme)
+	}
+
+	// The path and query of the backend URL are joined with those of the
+	// request, like the URL of the Functions emulator
+	// `http://localhost:5001/project/us-central1/api`.
+	proxy := httputil.NewSingleHostReverseProxy(u)
+	director := proxy.Director
+	proxy.Director = func(r *http.Request) {
+		r.Header.Set("X-Forwarded-Host", r.Host)
+		r.Header.Set("X-Forwarded-Proto", "https")
+		director(r)
+		r.Host = u.Host
+	}
+	proxy.Transport = transport
+	// Flush immediately so streamed responses reach the client.
+	proxy.FlushInterval = -1
+	return proxy, nil
+}
+
+// serveBackend proxies the request to the local backend configured for a
+// rewrite target.
+func serveBackend(w http.ResponseWriter, r *http.Request, kind, name string) {
+	backend, ok := localBackends[kind+":"+name]
+	if !ok {
+		log.Printf("--> No local backend configured for %s %s", kind, name)
+		http.Error(w, fmt.Sprintf("No local backend configured for %s %s", kind, name), http.StatusBadGateway)
+		return
+	}
+	log.Printf("--> Proxy to %s %s", kind, name)
+	// Streamed responses, like Server-Sent Events or long polls, outlive
+	// the write timeout of the server.
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+	backend.ServeHTTP(w, r)
+}
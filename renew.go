@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"time"
+)
+
+var (
+	// renewBefore is how long before expiry certificates generated by
+	// simplehttp2server are issued again, warnBefore how long before
+	// expiry user-supplied certificates are warned about.
+	renewBefore = 30 * 24 * time.Hour
+	warnBefore  = 14 * 24 * time.Hour
+	// expiryCheckInterval is how often certificates are checked while the
+	// server is running.
+	expiryCheckInterval = 1 * time.Hour
+)
+
+// expiresSoon reports whether a generated certificate is due for renewal:
+// less than a third of its validity, and at most renewBefore, is left.
+func expiresSoon(cert *x509.Certificate) bool {
+	threshold := cert.NotAfter.Sub(cert.NotBefore) / 3
+	if threshold > renewBefore {
+		threshold = renewBefore
+	}
+	return time.Until(cert.NotAfter) < threshold
+}
+
+// checkPeriodically calls check every expiryCheckInterval.
+func checkPeriodically(check func()) {
+	for range time.Tick(expiryCheckInterval) {
+		check()
+	}
+}
+
+// checkExpiry renews the local CA if it expires soon. Certificates issued
+// by the CA are renewed as they are requested.
+func (ca *localCA) checkExpiry() {
+	if err := ca.renew(); err != nil {
+		log.Printf("WARNING: Error renewing the local CA in %s: %s", ca.dir, err)
+	}
+}
+
+// checkExpiry issues the certificate again if it has been generated by
+// simplehttp2server and expires soon, and warns if a certificate supplied
+// by the user is about to expire.
+func (kp *keyPair) checkExpiry() {
+	cert := kp.cert.Load().(*tls.Certificate)
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return
+	}
+	if isGenerated(leaf) && expiresSoon(leaf) {
+		err := kp.renew(cert, leaf)
+		if err == nil {
+			return
+		}
+		log.Printf("Error renewing certificate %s: %s", kp.certPath, err)
+	}
+
+	left := time.Until(leaf.NotAfter)
+	switch {
+	case left < 0:
+		log.Printf("WARNING: Certificate %s EXPIRED on %s, browsers will reject it. Replace it, it is reloaded automatically.", kp.certPath, leaf.NotAfter.Format(time.RFC3339))
+	case left < warnBefore:
+		log.Printf("WARNING: Certificate %s expires in %d days on %s. Replace it, it is reloaded automatically.", kp.certPath, int(left.Hours()/24), leaf.NotAfter.Format(time.RFC3339))
+	}
+}
+
+// renew issues a generated certificate again with the same hostnames, key
+// and validity. It is signed by the local CA unless it was self-signed.
+func (kp *keyPair) renew(cert *tls.Certificate, leaf *x509.Certificate) error {
+	hosts := certificateHosts(leaf)
+	key, ok := cert.PrivateKey.(crypto.Signer)
+	if len(hosts) == 0 || !ok {
+		return fmt.Errorf("Can’t renew a certificate without hostnames or with an unsupported key")
+	}
+	var parent *x509.Certificate
+	var parentKey crypto.Signer
+	if describeIssuer(leaf) != "self-signed" {
+		dir, err := defaultCADir()
+		if err != nil {
+			return err
+		}
+		ca, err := loadCA(dir)
+		if err != nil {
+			return err
+		}
+		parent, parentKey = ca.cert, ca.key
+	}
+	// Generated certificates are backdated by an hour.
+	validFor := leaf.NotAfter.Sub(leaf.NotBefore) - time.Hour
+	renewed, err := createCertificate(hosts, key, validFor, parent, parentKey)
+	if err != nil {
+		return err
+	}
+	if err := writePEM(kp.certPath, &pem.Block{Type: "CERTIFICATE", Bytes: renewed.Certificate[0]}, 0644); err != nil {
+		return err
+	}
+	log.Printf("Renewed certificate %s, valid until %s", kp.certPath, renewed.Leaf.NotAfter.Format(time.RFC3339))
+	kp.reload()
+	return nil
+}
@@ -14,14 +14,12 @@ import (
 	"crypto/tls"
 	"flag"
 	"log"
-	"mime"
 	"net"
 	"net/http"
+	"os"
 	"regexp"
 	"strings"
 	"time"
-
-	"github.com/NYTimes/gziphandler"
 )
 
 const (
@@ -29,72 +27,140 @@ const (
 )
 
 var (
-	listen = flag.String("listen", ":5000", "Port to listen on")
-	cors   = flag.String("cors", "*", "Set allowed origins")
-	config = flag.String("config", "", "Config file")
+	listen          = flag.String("listen", ":5000", "Port to listen on")
+	cors            = flag.String("cors", "*", "Set allowed origins")
+	config          = flag.String("config", "", "Config file")
+	apps            = flag.String("apps", "", "Config file listing Android and iOS apps to generate app association files for")
+	backends        = flag.String("backends", "", "Config file mapping rewrite functions and services to local URLs")
+	target          = flag.String("target", "", "Hosting target or site to serve from a config with several sites")
+	country         = flag.String("country", "", "Country code of clients for i18n content, can be overridden with the X-Country-Code header")
+	listing         = flag.Bool("listing", false, "Serve styled directory listings, or JSON listings for clients accepting application/json")
+	livereload      = flag.Bool("livereload", false, "Reload pages when served files change, swapping stylesheets without a reload")
+	compress        = flag.String("compress", "br:5,zstd:3,gzip:6", "Encodings to compress responses with on the fly, in order of preference, as encoding:level or none")
+	compressTypes   = flag.String("compress-types", "text/*,application/javascript,application/json,application/manifest+json,application/xml,application/wasm,image/svg+xml", "Comma-separated MIME types to compress, text/* matches all text types")
+	compressMinSize = flag.Int("compress-min-size", 1024, "Minimum size in bytes of responses to compress")
+	certFile        = flag.String("cert", "cert.pem", "Certificate to serve instead of those issued by the local CA, reloaded when it changes")
+	keyFile         = flag.String("key", "key.pem", "Private key of the certificate")
+	certDir         = flag.String("cert-dir", "", "Directory relative -cert and -key paths are resolved against")
+	certHosts       = flag.String("cert-hosts", "", "Comma-separated hostnames besides localhost the local CA issues certificates for, *.example.test matches all subdomains")
+	keyType         = flag.String("key-type", "rsa2048", "Key type of the certificates issued by the local CA: rsa2048, rsa4096, p256, p384 or ed25519")
+	sitesFlag       = flag.String("sites", "", "Comma-separated sites to serve at once, as target=:port or target=hostname")
+	mountsFlag      mountList
+	vhostsFlag      vhostList
 )
 
+func init() {
+	flag.Var(&mountsFlag, "mount", "Serve a directory under a URL prefix, as prefix=path (can be repeated)")
+	flag.Var(&vhostsFlag, "vhost", "Serve a directory or config for a hostname, as hostname=dir or hostname=firebase.json (can be repeated)")
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		os.Exit(validateCommand(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "cert" {
+		os.Exit(certCommand(os.Args[2:]))
+	}
 	flag.Parse()
 
-	server := &http.Server{
-		Addr:         *listen,
-		ReadTimeout:  1 * time.Minute,
-		WriteTimeout: 1 * time.Minute,
-		TLSConfig: &tls.Config{
-			NextProtos:               []string{"h2", "h2-14"},
-			PreferServerCipherSuites: true,
-		},
+	if *backends != "" {
+		if err := readBackends(*backends); err != nil {
+			log.Fatalf("Error reading backends %s: %s", *backends, err)
+		}
 	}
 
-	server.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", *cors)
-		w.Header().Set("Access-Control-Allow-Methods", "GET, OPTION, HEAD, PATCH, PUT, POST, DELETE")
-		log.Printf("Request for %s (Accept-Encoding: %s)", r.URL.Path, r.Header.Get("Accept-Encoding"))
+	c, err := newCompressor(*compress, *compressTypes, *compressMinSize)
+	if err != nil {
+		log.Fatalf("Error configuring compression: %s", err)
+	}
+	responseCompressor = c
 
-		dir := "."
-		redirected := false
-		if *config != "" {
-			dir, redirected = processWithConfig(w, r, *config)
-		}
-		if redirected {
-			return
+	if *apps != "" {
+		if err := readApps(*apps); err != nil {
+			log.Fatalf("Error reading apps %s: %s", *apps, err)
 		}
-		if r.Header.Get(PushMarkerHeader) == "" {
-			pushResources(w)
+	}
+
+	sites, err := parseSites(*sitesFlag)
+	if err != nil {
+		log.Fatalf("Error parsing sites: %s", err)
+	}
+
+	router := &hostRouter{hosts: map[string]http.Handler{}}
+	// With -sites, the main listener only serves a fallback site if a
+	// target has been selected explicitly.
+	if len(sites) == 0 || *target != "" {
+		s, err := newSite(*config, *target)
+		if err != nil {
+			log.Fatalf("Error reading config %s: %s", *config, err)
 		}
+		router.fallback = s
+	}
 
-		// Add GZIP compression if it is a text-based format
-		fs := http.FileServer(http.Dir(dir))
-		typ := mime.TypeByExtension(r.URL.Path)
-		switch {
-		case strings.HasPrefix(typ, "text/"):
-			fallthrough
-		case typ == "application/xml":
-			fallthrough
-		case typ == "":
-			fs = gziphandler.GzipHandler(fs)
+	for _, vh := range vhostsFlag {
+		s, err := newVhostSite(vh)
+		if err != nil {
+			log.Fatalf("Error reading config %s for host %s: %s", vh.config, vh.host, err)
 		}
+		router.hosts[vh.host] = s
+		log.Printf("Serving %s%s for host %s", vh.dir, vh.config, vh.host)
+	}
 
-		fs.ServeHTTP(w, r)
-	})
+	servers := []*http.Server{newServer(*listen, router)}
+	for _, sa := range sites {
+		s, err := newSite(*config, sa.target)
+		if err != nil {
+			log.Fatalf("Error reading config %s for target %s: %s", *config, sa.target, err)
+		}
+		if sa.isHostname() {
+			router.hosts[strings.ToLower(sa.addr)] = s
+			log.Printf("Serving target %s for host %s", sa.target, sa.addr)
+			continue
+		}
+		servers = append(servers, newServer(sa.addr, s))
+	}
 
-	if err := configureTLS(server); err != nil {
+	hosts := []string{}
+	for host := range router.hosts {
+		hosts = append(hosts, host)
+	}
+	if err := configureTLS(servers[0], hosts); err != nil {
 		log.Fatalf("Error configuring TLS: %s", err)
 	}
+	for _, server := range servers[1:] {
+		server.TLSConfig = servers[0].TLSConfig
+		go listenAndServe(server)
+	}
+	listenAndServe(servers[0])
+}
+
+func newServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:         addr,
+		Handler:      handler,
+		ReadTimeout:  1 * time.Minute,
+		WriteTimeout: 1 * time.Minute,
+		TLSConfig: &tls.Config{
+			NextProtos:               []string{"h2", "h2-14"},
+			PreferServerCipherSuites: true,
+		},
+	}
+}
 
+func listenAndServe(server *http.Server) {
 	ln, err := net.Listen("tcp", server.Addr)
 	if err != nil {
 		log.Fatalf("Error opening socket: %s", err)
 	}
-	ln = &HijackHTTPListener{ln}
+	addr := server.Addr
+	if strings.HasPrefix(addr, ":") {
+		addr = "localhost" + addr
+	}
+	ln = &HijackHTTPListener{ln, addr}
 
 	tlsListener := tls.NewListener(ln, server.TLSConfig)
 	tcl := tlsListener
-	if strings.HasPrefix(*listen, ":") {
-		*listen = "localhost" + *listen
-	}
-	log.Printf("Listening on https://%s...", *listen)
+	log.Printf("Listening on https://%s...", addr)
 	if err := server.Serve(tcl); err != nil {
 		log.Fatalf("Error starting webserver: %s", err)
 	}
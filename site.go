@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// A site serves a directory, optionally configured by a config file.
+type site struct {
+	// dir is served if there is no config.
+	dir        string
+	rules      *configWatcher
+	liveReload *liveReload
+}
+
+func newSite(config, target string) (*site, error) {
+	s := &site{dir: "."}
+	if config != "" {
+		rules, err := newConfigWatcher(config, target, "")
+		if err != nil {
+			return nil, err
+		}
+		s.rules = rules
+	}
+	s.startLiveReload()
+	return s, nil
+}
+
+// newVhostSite creates the site of a virtual host. Relative dirs in its
+// config are resolved against the directory of the config, like the
+// Firebase CLI does.
+func newVhostSite(vh vhost) (*site, error) {
+	s := &site{dir: vh.dir}
+	if vh.config != "" {
+		rules, err := newConfigWatcher(vh.config, "", filepath.Dir(vh.config))
+		if err != nil {
+			return nil, err
+		}
+		s.rules = rules
+	}
+	s.startLiveReload()
+	return s, nil
+}
+
+func (s *site) startLiveReload() {
+	if *livereload {
+		s.liveReload = newLiveReload(s.publicDir)
+	}
+}
+
+// publicDir returns the public dir and a func reporting whether a path of
+// it is ignored.
+func (s *site) publicDir() (string, func(string) bool) {
+	if s.rules == nil {
+		return s.dir, func(string) bool { return false }
+	}
+	rs := s.rules.Ruleset()
+	return rs.dir, rs.ignored
+}
+
+func (s *site) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", *cors)
+	w.Header().Set("Access-Control-Allow-Methods", "GET, OPTION, HEAD, PATCH, PUT, POST, DELETE")
+	log.Printf("Request for %s (Accept-Encoding: %s)", r.URL.Path, r.Header.Get("Accept-Encoding"))
+	if s.liveReload != nil && (r.URL.Path == liveReloadEvents || r.URL.Path == liveReloadScript) {
+		s.liveReload.ServeHTTP(w, r)
+		return
+	}
+
+	var root http.FileSystem = newMountFS(http.Dir(s.dir), mountsFlag)
+	var rs *ruleset
+	if s.rules != nil {
+		rs = s.rules.Ruleset()
+		root = rs.fileSystem()
+	}
+	if (rs == nil || rs.appAssociation != "NONE") && serveAppAssociation(w, r, root) {
+		return
+	}
+
+	notFoundPage := defaultNotFoundPage
+	if rs != nil {
+		notFoundPage = rs.localizedFile(r, rs.notFoundPage(r.URL.Path))
+		if rs.process(w, r) {
+			return
+		}
+	}
+	if isWellKnownJSON(r.URL.Path) {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	if r.Header.Get(PushMarkerHeader) == "" {
+		pushResources(w)
+	}
+
+	// The live reload client can’t be added to precompressed HTML.
+	if (s.liveReload == nil || !strings.HasSuffix(r.URL.Path, "/") && path.Ext(r.URL.Path) != ".html") && servePrecompressed(w, r, root) {
+		return
+	}
+
+	fs := http.FileServer(root)
+	switch {
+	case *listing:
+		fs = listingHandler(fs, root)
+	case rs != nil:
+		fs = indexlessDirHandler(fs, root)
+	}
+	fs = notFoundHandler(fs, root, notFoundPage)
+	if s.liveReload != nil {
+		fs = injectLiveReload(fs)
+	}
+	fs = responseCompressor.Handler(fs)
+
+	fs.ServeHTTP(w, r)
+}
+
+// A siteAddr is an entry of the `-sites` flag. Sites are either served on
+// their own listen address (`target=:5001`) or on the main listener for a
+// hostname (`target=admin.localhost`).
+type siteAddr struct {
+	target, addr string
+}
+
+func (sa siteAddr) isHostname() bool {
+	return !strings.Contains(sa.addr, ":")
+}
+
+func parseSites(list string) ([]siteAddr, error) {
+	sites := []siteAddr{}
+	if list == "" {
+		return sites, nil
+	}
+	for _, entry := range strings.Split(list, ",") {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("Invalid site %q, expected target=address or target=hostname", entry)
+		}
+		sites = append(sites, siteAddr{parts[0], parts[1]})
+	}
+	return sites, nil
+}
+
+// A vhost is an entry of the `-vhost` flag, which serves a directory or the
+// public dir of a config for a hostname.
+type vhost struct {
+	host, dir, config string
+}
+
+// vhostList is the value of the repeatable `-vhost` flag.
+type vhostList []vhost
+
+func (vl *vhostList) String() string {
+	entries := []string{}
+	for _, vh := range *vl {
+		entries = append(entries, vh.host+"="+vh.dir+vh.config)
+	}
+	return strings.Join(entries, ",")
+}
+
+func (vl *vhostList) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" || strings.Contains(parts[0], ":") {
+		return fmt.Errorf("Invalid vhost %q, expected hostname=dir or hostname=config", value)
+	}
+	vh := vhost{host: strings.ToLower(parts[0])}
+	if strings.HasSuffix(parts[1], ".json") {
+		vh.config = parts[1]
+	} else {
+		vh.dir = parts[1]
+	}
+	*vl = append(*vl, vh)
+	return nil
+}
+
+// A hostRouter dispatches requests to sites by the hostname of the request.
+// Requests for other hostnames go to the fallback, if any.
+type hostRouter struct {
+	hosts    map[string]http.Handler
+	fallback http.Handler
+}
+
+func (hr *hostRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	// Without a Host header, the hostname the client sent using TLS SNI
+	// selects the site.
+	if host == "" && r.TLS != nil {
+		host = r.TLS.ServerName
+	}
+	if handler, ok := hr.hosts[strings.ToLower(host)]; ok {
+		handler.ServeHTTP(w, r)
+		return
+	}
+	if hr.fallback != nil {
+		hr.fallback.ServeHTTP(w, r)
+		return
+	}
+	http.Error(w, fmt.Sprintf("No site configured for host %s", host), http.StatusNotFound)
+}
@@ -0,0 +1,434 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+)
+
+func Test_AppAssociation(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{
+		"apps.json": `{
+			"android": [{"packageName": "com.example.app", "sha256CertFingerprints": ["AB:CD"]}],
+			"ios": [{"appId": "TEAM.com.example.app"}]
+		}`,
+		"public/.well-known/custom": `{"custom": true}`,
+	})
+	defer os.RemoveAll(dir)
+	if err := readApps(filepath.Join(dir, "apps.json")); err != nil {
+		t.Fatalf("Couldn’t read apps: %s", err)
+	}
+	defer func() { localApps = nil }()
+	rs := &ruleset{dir: filepath.Join(dir, "public")}
+	s := &site{}
+	s.rules = &configWatcher{}
+	s.rules.rules.Store(rs)
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/.well-known/assetlinks.json", nil))
+	var links []struct {
+		Target struct {
+			PackageName string `json:"package_name"`
+		} `json:"target"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &links); err != nil || len(links) != 1 || links[0].Target.PackageName != "com.example.app" {
+		t.Fatalf("Unexpected assetlinks.json %s: %v", w.Body, err)
+	}
+
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/.well-known/apple-app-site-association", nil))
+	if w.Header().Get("Content-Type") != "application/json" || !strings.Contains(w.Body.String(), `"appID":"TEAM.com.example.app"`) {
+		t.Fatalf("Unexpected apple-app-site-association %s", w.Body)
+	}
+
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/.well-known/custom", nil))
+	if w.Header().Get("Content-Type") != "application/json" || w.Body.String() != `{"custom": true}` {
+		t.Fatalf("Unexpected .well-known file %s (%s)", w.Body, w.Header().Get("Content-Type"))
+	}
+
+	rs.appAssociation = "NONE"
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/.well-known/assetlinks.json", nil))
+	if w.Code != 404 {
+		t.Fatalf("assetlinks.json was served with appAssociation NONE")
+	}
+}
+
+func Test_Pipeline(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{
+		"index.html":     "index",
+		"moved.html":     "moved",
+		"static.txt":     "static",
+		"404.html":       "not found",
+		"__/init.js":     "init",
+		"app/index.html": "app",
+		"assets/app.css": "body{}",
+	})
+	defer os.RemoveAll(dir)
+	mf := FirebaseManifest{}
+	if err := json.Unmarshal([]byte(`{
+		"redirects": [
+			{"source": "/moved.html", "destination": "/", "type": 301},
+			{"source": "/__/**", "destination": "/", "type": 301}
+		],
+		"rewrites": [
+			{"source": "/app/**", "destination": "/app/index.html"},
+			{"source": "**", "destination": "/index.html"}
+		],
+		"headers": [
+			{"source": "/moved.html", "headers": [{"key": "X-Rule", "value": "redirect"}]},
+			{"source": "/app/**", "headers": [{"key": "X-Rule", "value": "app"}]},
+			{"source": "/index.html", "headers": [{"key": "X-Index", "value": "yes"}]},
+			{"source": "/missing/**", "headers": [{"key": "Cache-Control", "value": "no-store"}]}
+		]
+	}`), &mf); err != nil {
+		t.Fatalf("Couldn’t parse manifest: %s", err)
+	}
+	rs, err := compileManifest(mf, "")
+	if err != nil {
+		t.Fatalf("Couldn’t compile manifest: %s", err)
+	}
+	rs.dir = dir
+	s := &site{rules: &configWatcher{}}
+	s.rules.rules.Store(rs)
+
+	table := []struct {
+		Path, Code, Body, Header, Value string
+	}{
+		// Reserved namespaces come first and skip all rules.
+		{"/__/init.js", "200", "init", "X-Rule", ""},
+		// Redirects take precedence over existing files.
+		{"/moved.html", "301", "", "X-Rule", "redirect"},
+		// Existing files take precedence over rewrites.
+		{"/static.txt", "200", "static", "X-Rule", ""},
+		// Headers match the original path, not the rewritten one.
+		{"/app/settings", "200", "app", "X-Rule", "app"},
+		{"/app/settings", "200", "app", "X-Index", ""},
+		{"/anything", "200", "index", "X-Index", ""},
+		// Directories without an index aren’t static content.
+		{"/assets", "200", "index", "X-Index", ""},
+		{"/assets/", "200", "index", "X-Index", ""},
+	}
+	for _, entry := range table {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("GET", entry.Path, nil))
+		if code := strconv.Itoa(w.Code); code != entry.Code || !strings.HasPrefix(w.Body.String(), entry.Body) || w.Header().Get(entry.Header) != entry.Value {
+			t.Fatalf("%s: got %s %q with %s: %q", entry.Path, code, w.Body, entry.Header, w.Header().Get(entry.Header))
+		}
+	}
+
+	// Without a catch-all rewrite, missing files get the 404 page with the
+	// configured headers.
+	rs.rewrites = rs.rewrites[:1]
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/missing/page", nil))
+	if w.Code != 404 || w.Body.String() != "not found" || w.Header().Get("Cache-Control") != "no-store" {
+		t.Fatalf("Got %d %q with Cache-Control %q", w.Code, w.Body, w.Header().Get("Cache-Control"))
+	}
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/assets/", nil))
+	if w.Code != 404 || w.Body.String() != "not found" {
+		t.Fatalf("Directory without index returned %d %q", w.Code, w.Body)
+	}
+
+	// With -listing, directories are listed instead.
+	*listing = true
+	defer func() { *listing = false }()
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/assets/", nil))
+	if w.Code != 200 || !strings.Contains(w.Body.String(), "app.css") {
+		t.Fatalf("Directory wasn’t listed: %d %q", w.Code, w.Body)
+	}
+}
+
+func Test_Vhosts(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{
+		"app/firebase.json":   `{"public": "dist", "rewrites": [{"source": "**", "destination": "/index.html"}]}`,
+		"app/dist/index.html": "app",
+		"docs/index.html":     "docs",
+	})
+	defer os.RemoveAll(dir)
+	vhosts := vhostList{}
+	for _, value := range []string{
+		"App.localhost=" + filepath.Join(dir, "app", "firebase.json"),
+		"docs.localhost=" + filepath.Join(dir, "docs"),
+	} {
+		if err := vhosts.Set(value); err != nil {
+			t.Fatalf("Couldn’t parse vhost %s: %s", value, err)
+		}
+	}
+	if err := vhosts.Set("localhost:5000=docs"); err == nil {
+		t.Fatalf("Vhost with a port was accepted")
+	}
+
+	router := &hostRouter{hosts: map[string]http.Handler{}}
+	for _, vh := range vhosts {
+		s, err := newVhostSite(vh)
+		if err != nil {
+			t.Fatalf("Couldn’t create site for %s: %s", vh.host, err)
+		}
+		router.hosts[vh.host] = s
+	}
+
+	table := []struct {
+		Host, Path string
+		Code       int
+		Body       string
+	}{
+		{"app.localhost:5000", "/settings", 200, "app"},
+		{"docs.localhost", "/", 200, "docs"},
+		{"other.localhost", "/", 404, ""},
+	}
+	for _, entry := range table {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", entry.Path, nil)
+		r.Host = entry.Host
+		router.ServeHTTP(w, r)
+		if w.Code != entry.Code || entry.Body != "" && w.Body.String() != entry.Body {
+			t.Fatalf("%s%s: got %d %q", entry.Host, entry.Path, w.Code, w.Body)
+		}
+	}
+}
+
+func Test_Listing(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{
+		"dist/app.js":        "console.log('app');",
+		"dist/b.css":         "body{}",
+		"dist/assets/a.png":  "png",
+		"docs/index.html":    "docs",
+		"dist/with space.js": "",
+	})
+	defer os.RemoveAll(dir)
+	h := listingHandler(http.FileServer(http.Dir(dir)), http.Dir(dir))
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/dist/?sort=size&order=desc", nil)
+	r.Header.Set("Accept", "application/json")
+	h.ServeHTTP(w, r)
+	var l dirListing
+	if err := json.Unmarshal(w.Body.Bytes(), &l); err != nil {
+		t.Fatalf("Invalid JSON listing %s: %s", w.Body, err)
+	}
+	names := []string{}
+	for _, entry := range l.Entries {
+		names = append(names, entry.Name)
+	}
+	if strings.Join(names, ",") != "assets,app.js,b.css,with space.js" || l.Entries[3].Path != "/dist/with%20space.js" {
+		t.Fatalf("Unexpected listing %s", w.Body)
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/dist/assets/", nil))
+	if body := w.Body.String(); !strings.Contains(body, `<a href="/dist/">dist</a>`) || !strings.Contains(body, `<a href="/dist/assets/a.png">a.png</a>`) {
+		t.Fatalf("Unexpected HTML listing %s", body)
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/dist?sort=size", nil))
+	if location := w.Header().Get("Location"); location != "/dist/?sort=size" {
+		t.Fatalf("Redirected to %q", location)
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/docs/", nil))
+	if w.Body.String() != "docs" {
+		t.Fatalf("Directory with index.html was listed: %s", w.Body)
+	}
+}
+
+func Test_ScanDir(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{
+		"index.html":               "index",
+		"css/app.css":              "body{}",
+		".env":                     "SECRET=1",
+		"drafts/post.html":         "draft",
+		"node_modules/lib/lib.js":  "lib",
+		"css/node_modules/a/a.css": "a",
+	})
+	defer os.RemoveAll(dir)
+	stamps := scanDir(dir, func(path string) bool { return strings.HasPrefix(path, "/drafts") })
+	names := []string{}
+	for name := range stamps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if strings.Join(names, ",") != "/css/app.css,/index.html" {
+		t.Fatalf("Scanned %v", names)
+	}
+}
+
+func Test_LiveReloadInjection(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{
+		"page.html": "<p>" + strings.Repeat("page ", 400) + "</p>",
+		"app.js":    "console.log('app');",
+	})
+	defer os.RemoveAll(dir)
+	c, err := newCompressor("gzip", "text/*", 1024)
+	if err != nil {
+		t.Fatalf("Couldn’t create compressor: %s", err)
+	}
+	h := c.Handler(injectLiveReload(http.FileServer(http.Dir(dir))))
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/page.html", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	h.ServeHTTP(w, r)
+	gz, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatalf("Response isn’t gzipped: %s", err)
+	}
+	body, _ := ioutil.ReadAll(gz)
+	if !strings.HasSuffix(string(body), `<script src="/__/livereload.js"></script>`+"\n") {
+		t.Fatalf("Script wasn’t injected: %s", body)
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/app.js", nil))
+	if w.Body.String() != "console.log('app');" {
+		t.Fatalf("Script was injected into JavaScript: %s", w.Body)
+	}
+}
+
+func Test_Precompressed(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{
+		"app.js":     "plain",
+		"app.js.br":  "brotli",
+		"app.js.gz":  "gzip",
+		"only.js.gz": "orphan",
+	})
+	defer os.RemoveAll(dir)
+
+	table := []struct {
+		Path, AcceptEncoding, Encoding, Body string
+	}{
+		{"/app.js", "gzip, deflate, br", "br", "brotli"},
+		{"/app.js", "gzip;q=1.0, br;q=0", "gzip", "gzip"},
+		{"/app.js", "*", "br", "brotli"},
+		{"/app.js", "identity", "", ""},
+		{"/only.js", "gzip", "", ""},
+	}
+	for _, entry := range table {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", entry.Path, nil)
+		r.Header.Set("Accept-Encoding", entry.AcceptEncoding)
+		served := servePrecompressed(w, r, http.Dir(dir))
+		if served != (entry.Encoding != "") || w.Header().Get("Content-Encoding") != entry.Encoding || w.Body.String() != entry.Body {
+			t.Fatalf("%s with %q: got %q encoded as %q", entry.Path, entry.AcceptEncoding, w.Body, w.Header().Get("Content-Encoding"))
+		}
+		if served && (w.Header().Get("Vary") != "Accept-Encoding" || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/javascript")) {
+			t.Fatalf("%s got Vary %q and Content-Type %q", entry.Path, w.Header().Get("Vary"), w.Header().Get("Content-Type"))
+		}
+	}
+}
+
+func Test_Compression(t *testing.T) {
+	script := strings.Repeat("console.log('app');\n", 100)
+	dir := writeTestFiles(t, map[string]string{
+		"app.js":    script,
+		"copy.js":   script,
+		"small.js":  "console.log('small');",
+		"image.png": strings.Repeat("png", 1000),
+		"large.txt": strings.Repeat("large\n", maxBufferedSize/5),
+	})
+	defer os.RemoveAll(dir)
+	if _, err := newCompressor("br:12", "", 0); err == nil {
+		t.Fatalf("Invalid Brotli level was accepted")
+	}
+	c, err := newCompressor("br:5,zstd,gzip:9", "text/*,application/wasm", 1024)
+	if err != nil {
+		t.Fatalf("Couldn’t create compressor: %s", err)
+	}
+	h := c.Handler(http.FileServer(http.Dir(dir)))
+
+	table := []struct {
+		Path, AcceptEncoding, Encoding string
+	}{
+		{"/app.js", "gzip, deflate, br, zstd", "br"},
+		{"/copy.js", "gzip, br;q=0, zstd", "zstd"},
+		{"/app.js", "gzip", "gzip"},
+		{"/small.js", "gzip, br", ""},
+		{"/image.png", "gzip, br", ""},
+	}
+	for _, entry := range table {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", entry.Path, nil)
+		r.Header.Set("Accept-Encoding", entry.AcceptEncoding)
+		h.ServeHTTP(w, r)
+		if encoding := w.Header().Get("Content-Encoding"); encoding != entry.Encoding {
+			t.Fatalf("%s with %q was encoded with %q", entry.Path, entry.AcceptEncoding, encoding)
+		}
+		if entry.Encoding != "" && w.Header().Get("Content-Length") != strconv.Itoa(w.Body.Len()) {
+			t.Fatalf("%s has Content-Length %s for %d bytes", entry.Path, w.Header().Get("Content-Length"), w.Body.Len())
+		}
+		if entry.Encoding != "" && w.Header().Get("Accept-Ranges") != "" {
+			t.Fatalf("%s has Accept-Ranges although it was encoded", entry.Path)
+		}
+	}
+
+	// Brotli and zstd of the identical app.js and copy.js are cached once.
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/copy.js", nil)
+	r.Header.Set("Accept-Encoding", "br")
+	h.ServeHTTP(w, r)
+	if len(c.cache.entries) != 3 {
+		t.Fatalf("Expected 3 cached responses, got %d", len(c.cache.entries))
+	}
+	body, err := ioutil.ReadAll(brotli.NewReader(w.Body))
+	if err != nil || string(body) != script {
+		t.Fatalf("Couldn’t decode Brotli response: %v", err)
+	}
+
+	// Large responses are compressed as they are written.
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("GET", "/large.txt", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	h.ServeHTTP(w, r)
+	gz, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatalf("Large response isn’t gzipped: %s", err)
+	}
+	if body, _ := ioutil.ReadAll(gz); len(body) != maxBufferedSize/5*6 || w.Header().Get("Content-Length") != "" || w.Header().Get("Accept-Ranges") != "" {
+		t.Fatalf("Large response decoded to %d bytes with Content-Length %q", len(body), w.Header().Get("Content-Length"))
+	}
+
+	// HEAD gets the header of GET and ranges are passed through. 404s are
+	// compressed, see Test_NotFoundHandler.
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("HEAD", "/app.js", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	h.ServeHTTP(w, r)
+	if w.Header().Get("Content-Encoding") != "gzip" || w.Header().Get("Content-Length") != "" || w.Body.Len() != 0 {
+		t.Fatalf("HEAD got Content-Encoding %q and Content-Length %q", w.Header().Get("Content-Encoding"), w.Header().Get("Content-Length"))
+	}
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("GET", "/app.js", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	r.Header.Set("Range", "bytes=0-9")
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusPartialContent || w.Header().Get("Content-Encoding") != "" || w.Body.String() != script[:10] {
+		t.Fatalf("Range request returned %d with Content-Encoding %q", w.Code, w.Header().Get("Content-Encoding"))
+	}
+
+	// Accept-Encoding is listed in Vary once.
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("GET", "/app.js", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	c.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Vary", "Origin, Accept-Encoding")
+		http.FileServer(http.Dir(dir)).ServeHTTP(w, r)
+	})).ServeHTTP(w, r)
+	if vary := w.Header().Values("Vary"); len(vary) != 1 || w.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("Got Vary %q", vary)
+	}
+}
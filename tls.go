@@ -1,140 +1,210 @@
 package main
 
 import (
+	"crypto"
 	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
-	"crypto/x509/pkix"
 	"encoding/pem"
+	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
-	"math/big"
-	"net"
 	"net/http"
-	"os"
+	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
 var (
-	validFrom  = time.Now()
-	validFor   = 365 * 24 * time.Hour
-	isCA       = true
-	rsaBits    = 2048
-	ecdsaCurve = ""
+	// caValidFor is the validity of the local CA, leafValidFor the validity
+	// of the certificates it issues.
+	caValidFor   = 2 * 365 * 24 * time.Hour
+	leafValidFor = 7 * 24 * time.Hour
+	// caKeyType is the key type of a newly created local CA.
+	caKeyType = "rsa2048"
+	// generatedOrganizations mark certificates generated by
+	// simplehttp2server. Older versions used "Acme Co".
+	generatedOrganizations = []string{"simplehttp2server", "Acme Co"}
 )
 
-func publicKey(priv interface{}) interface{} {
-	switch k := priv.(type) {
-	case *rsa.PrivateKey:
-		return &k.PublicKey
-	case *ecdsa.PrivateKey:
-		return &k.PublicKey
-	default:
-		return nil
-	}
+// keyTypes generate the private keys of the supported key types.
+var keyTypes = map[string]func() (crypto.Signer, error){
+	"rsa2048": func() (crypto.Signer, error) { return rsa.GenerateKey(rand.Reader, 2048) },
+	"rsa4096": func() (crypto.Signer, error) { return rsa.GenerateKey(rand.Reader, 4096) },
+	"p256":    func() (crypto.Signer, error) { return ecdsa.GenerateKey(elliptic.P256(), rand.Reader) },
+	"p384":    func() (crypto.Signer, error) { return ecdsa.GenerateKey(elliptic.P384(), rand.Reader) },
+	"ed25519": func() (crypto.Signer, error) {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	},
 }
 
-func pemBlockForKey(priv interface{}) *pem.Block {
-	switch k := priv.(type) {
-	case *rsa.PrivateKey:
-		return &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(k)}
-	case *ecdsa.PrivateKey:
-		b, err := x509.MarshalECPrivateKey(k)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Unable to marshal ECDSA private key: %v", err)
-			os.Exit(2)
-		}
-		return &pem.Block{Type: "EC PRIVATE KEY", Bytes: b}
-	default:
-		return nil
+// newKey generates a private key of the given type.
+func newKey(keyType string) (crypto.Signer, error) {
+	generate, ok := keyTypes[keyType]
+	if !ok {
+		return nil, fmt.Errorf("Invalid key type %s, must be rsa2048, rsa4096, p256, p384 or ed25519", keyType)
 	}
+	return generate()
 }
 
-func generateCertificates(host string) {
-	var priv interface{}
-	var err error
-	priv, err = rsa.GenerateKey(rand.Reader, rsaBits)
-	if err != nil {
-		log.Fatalf("failed to generate private key: %s", err)
-	}
-
-	var notBefore = validFrom
-	notAfter := notBefore.Add(validFor)
-
-	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
-	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
+// pemBlockForKey encodes a private key as PKCS#8.
+func pemBlockForKey(key crypto.Signer) (*pem.Block, error) {
+	b, err := x509.MarshalPKCS8PrivateKey(key)
 	if err != nil {
-		log.Fatalf("failed to generate serial number: %s", err)
+		return nil, err
 	}
+	return &pem.Block{Type: "PRIVATE KEY", Bytes: b}, nil
+}
 
-	template := x509.Certificate{
-		SerialNumber: serialNumber,
-		Subject: pkix.Name{
-			Organization: []string{"Acme Co"},
-		},
-		NotBefore: notBefore,
-		NotAfter:  notAfter,
-
-		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
-		BasicConstraintsValid: true,
+// isGenerated reports whether cert has been generated by simplehttp2server.
+func isGenerated(cert *x509.Certificate) bool {
+	for _, org := range cert.Subject.Organization {
+		for _, generated := range generatedOrganizations {
+			if org == generated {
+				return true
+			}
+		}
 	}
+	return false
+}
 
-	hosts := strings.Split(host, ",")
-	for _, h := range hosts {
-		if ip := net.ParseIP(h); ip != nil {
-			template.IPAddresses = append(template.IPAddresses, ip)
-		} else {
-			template.DNSNames = append(template.DNSNames, h)
+// certPaths returns the paths of the user-supplied certificate and key.
+// Relative paths are resolved against `-cert-dir`.
+func certPaths() (string, string) {
+	resolve := func(path string) string {
+		if filepath.IsAbs(path) {
+			return path
 		}
+		return filepath.Join(*certDir, path)
 	}
+	return resolve(*certFile), resolve(*keyFile)
+}
 
-	if isCA {
-		template.IsCA = true
-		template.KeyUsage |= x509.KeyUsageCertSign
-	}
+// certFlagsPassed reports whether the certificate was chosen explicitly,
+// in which case it has to exist.
+func certFlagsPassed() bool {
+	passed := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "cert" || f.Name == "key" || f.Name == "cert-dir" {
+			passed = true
+		}
+	})
+	return passed
+}
 
-	derBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, publicKey(priv), priv)
+// userCertificate reports whether the certificate at path is supplied by
+// the user. Certificates generated by older versions are not.
+func userCertificate(path string) bool {
+	data, err := ioutil.ReadFile(path)
 	if err != nil {
-		log.Fatalf("Failed to create certificate: %s", err)
+		return false
 	}
-
-	certOut, err := os.Create("cert.pem")
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return true
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
 	if err != nil {
-		log.Fatalf("failed to open cert.pem for writing: %s", err)
+		return true
+	}
+	// Older versions generated a self-signed CA certificate.
+	if cert.IsCA && isGenerated(cert) {
+		log.Printf("Ignoring %s generated by an older version of simplehttp2server, it can be deleted", path)
+		return false
 	}
-	pem.Encode(certOut, &pem.Block{Type: "CERTIFICATE", Bytes: derBytes})
-	certOut.Close()
-	log.Print("written cert.pem\n")
+	return true
+}
 
-	keyOut, err := os.OpenFile("key.pem", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+// A keyPair holds a certificate and key loaded from files and loads them
+// again whenever the files change. If the changed files are invalid, the
+// last valid pair is kept. Established connections are not affected.
+type keyPair struct {
+	certPath, keyPath string
+	cert              atomic.Value
+}
+
+func newKeyPair(certPath, keyPath string) (*keyPair, error) {
+	kp := &keyPair{certPath: certPath, keyPath: keyPath}
+	cert, err := kp.load()
 	if err != nil {
-		log.Print("failed to open key.pem for writing:", err)
-		return
+		return nil, err
 	}
-	pem.Encode(keyOut, pemBlockForKey(priv))
-	keyOut.Close()
-	log.Print("written key.pem\n")
+	kp.cert.Store(cert)
+	go watchFiles(kp.reload, certPath, keyPath)
+	return kp, nil
 }
 
-func configureTLS(server *http.Server) error {
-	if _, err := os.Stat("cert.pem"); err != nil {
-		log.Printf("Generating certificate...")
-		generateCertificates("localhost")
+func (kp *keyPair) load() (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(kp.certPath, kp.keyPath)
+	if err != nil {
+		return nil, err
 	}
+	return &cert, nil
+}
 
-	cert, err := tls.LoadX509KeyPair("cert.pem", "key.pem")
+func (kp *keyPair) reload() {
+	cert, err := kp.load()
 	if err != nil {
-		return err
+		log.Printf("Certificate %s is invalid, keeping the previous certificate: %s", kp.certPath, err)
+		return
 	}
+	kp.cert.Store(cert)
+	log.Printf("Reloaded certificate %s", kp.certPath)
+}
+
+func (kp *keyPair) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return kp.cert.Load().(*tls.Certificate), nil
+}
 
+// configureTLS uses the certificate and key supplied by the user, if any.
+// Otherwise, certificates are issued by the local CA for localhost, the
+// given hostnames of vhosts and sites, and those of `-cert-hosts`.
+func configureTLS(server *http.Server, hosts []string) error {
 	if server.TLSConfig == nil {
 		server.TLSConfig = &tls.Config{}
 	}
 	server.TLSConfig.PreferServerCipherSuites = true
 	server.TLSConfig.NextProtos = append(server.TLSConfig.NextProtos, "http/1.1")
-	server.TLSConfig.Certificates = []tls.Certificate{cert}
+
+	certPath, keyPath := certPaths()
+	if certFlagsPassed() || userCertificate(certPath) {
+		kp, err := newKeyPair(certPath, keyPath)
+		if err != nil {
+			return err
+		}
+		log.Printf("Using certificate %s", certPath)
+		kp.checkExpiry()
+		go checkPeriodically(kp.checkExpiry)
+		server.TLSConfig.GetCertificate = kp.GetCertificate
+		return nil
+	}
+
+	dir, err := defaultCADir()
+	if err != nil {
+		return err
+	}
+	ca, err := loadCA(dir)
+	if err != nil {
+		return err
+	}
+	if ca.leafKey, err = newKey(*keyType); err != nil {
+		return err
+	}
+	ca.hosts = hosts
+	for _, host := range strings.Split(*certHosts, ",") {
+		if host = strings.ToLower(strings.TrimSpace(host)); host != "" {
+			ca.hosts = append(ca.hosts, host)
+		}
+	}
+	log.Printf("Using the local CA %s, trust it to get rid of certificate warnings", filepath.Join(dir, "ca.pem"))
+	go checkPeriodically(ca.checkExpiry)
+	server.TLSConfig.GetCertificate = ca.GetCertificate
 	return nil
 }
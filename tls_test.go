@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+func Test_LocalCA(t *testing.T) {
+	dir, err := ioutil.TempDir("", "simplehttp2server")
+	if err != nil {
+		t.Fatalf("Couldn’t create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca, err := loadCA(dir)
+	if err != nil {
+		t.Fatalf("Couldn’t create CA: %s", err)
+	}
+	if reloaded, err := loadCA(dir); err != nil || !reloaded.cert.Equal(ca.cert) {
+		t.Fatalf("CA wasn’t reused: %v", err)
+	}
+
+	ca.hosts = []string{"192.168.1.20", "*.example.test"}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	for _, name := range []string{"app.localhost", "192.168.1.20", "dev.example.test"} {
+		cert, err := ca.GetCertificate(&tls.ClientHelloInfo{ServerName: name})
+		if err != nil {
+			t.Fatalf("Couldn’t issue certificate for %s: %s", name, err)
+		}
+		if _, err := cert.Leaf.Verify(x509.VerifyOptions{DNSName: name, Roots: roots}); err != nil {
+			t.Fatalf("Certificate for %s doesn’t verify: %s", name, err)
+		}
+		if again, _ := ca.GetCertificate(&tls.ClientHelloInfo{ServerName: name}); again != cert {
+			t.Fatalf("Certificate for %s was issued again", name)
+		}
+	}
+	for _, name := range []string{"example.com", "example.test", "localhost.example.com"} {
+		if _, err := ca.GetCertificate(&tls.ClientHelloInfo{ServerName: name}); err == nil {
+			t.Fatalf("Certificate for %s was issued", name)
+		}
+	}
+}
+
+func Test_CertificateFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "simplehttp2server")
+	if err != nil {
+		t.Fatalf("Couldn’t create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	os.Setenv("XDG_CONFIG_HOME", dir)
+	defer os.Unsetenv("XDG_CONFIG_HOME")
+
+	key, err := newKey("p256")
+	if err != nil {
+		t.Fatalf("Couldn’t generate key: %s", err)
+	}
+	cert, err := createCertificate([]string{"localhost", "127.0.0.1"}, key, time.Hour, nil, nil)
+	if err != nil {
+		t.Fatalf("Couldn’t create certificate: %s", err)
+	}
+	certPath, keyPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writePEM(certPath, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}, 0644)
+	block, err := pemBlockForKey(key)
+	if err != nil {
+		t.Fatalf("Couldn’t encode key: %s", err)
+	}
+	writePEM(keyPath, block, 0600)
+
+	parsed, err := readCertificate(certPath)
+	if err != nil || describeIssuer(parsed) != "self-signed" || strings.Join(certificateHosts(parsed), ",") != "localhost,127.0.0.1" {
+		t.Fatalf("Unexpected certificate: %v", err)
+	}
+	if readKey, err := readKey(keyPath); err != nil || !keyMatches(parsed, readKey) {
+		t.Fatalf("Key doesn’t match: %v", err)
+	}
+	if other, _ := newKey("p256"); keyMatches(parsed, other) {
+		t.Fatalf("Other key matches")
+	}
+
+	data, err := encodePKCS12(parsed, keyPath, false, "secret", false)
+	if err != nil {
+		t.Fatalf("Couldn’t encode PKCS#12: %s", err)
+	}
+	if _, decoded, err := pkcs12.Decode(data, "secret"); err != nil || !decoded.Equal(parsed) {
+		t.Fatalf("Couldn’t decode PKCS#12: %v", err)
+	}
+}
+
+func Test_KeyTypes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "simplehttp2server")
+	if err != nil {
+		t.Fatalf("Couldn’t create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, keyType := range []string{"rsa2048", "p256", "p384", "ed25519"} {
+		key, err := newKey(keyType)
+		if err != nil {
+			t.Fatalf("Couldn’t generate %s key: %s", keyType, err)
+		}
+		cert, err := createCertificate([]string{"localhost"}, key, time.Hour, nil, nil)
+		if err != nil {
+			t.Fatalf("Couldn’t create %s certificate: %s", keyType, err)
+		}
+		block, err := pemBlockForKey(key)
+		if err != nil || block.Type != "PRIVATE KEY" {
+			t.Fatalf("%s key isn’t PKCS#8: %v", keyType, err)
+		}
+		keyPath := filepath.Join(dir, keyType+".pem")
+		writePEM(keyPath, block, 0600)
+		if readKey, err := readKey(keyPath); err != nil || !keyMatches(cert.Leaf, readKey) {
+			t.Fatalf("%s key doesn’t match: %v", keyType, err)
+		}
+	}
+	if _, err := newKey("dsa"); err == nil {
+		t.Fatalf("Invalid key type was accepted")
+	}
+}
+
+func Test_KeyPairReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "simplehttp2server")
+	if err != nil {
+		t.Fatalf("Couldn’t create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	certPath, keyPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	write := func(host string) *tls.Certificate {
+		key, _ := newKey("p256")
+		cert, err := createCertificate([]string{host}, key, time.Hour, nil, nil)
+		if err != nil {
+			t.Fatalf("Couldn’t create certificate: %s", err)
+		}
+		block, _ := pemBlockForKey(key)
+		writePEM(certPath, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}, 0644)
+		writePEM(keyPath, block, 0600)
+		return cert
+	}
+	served := func(kp *keyPair) string {
+		cert, _ := kp.GetCertificate(&tls.ClientHelloInfo{})
+		leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+		return leaf.Subject.CommonName
+	}
+
+	write("first.test")
+	kp, err := newKeyPair(certPath, keyPath)
+	if err != nil {
+		t.Fatalf("Couldn’t load key pair: %s", err)
+	}
+
+	ioutil.WriteFile(certPath, []byte("not a certificate"), 0644)
+	kp.reload()
+	if host := served(kp); host != "first.test" {
+		t.Fatalf("Invalid certificate replaced the previous one, serving %s", host)
+	}
+
+	write("second.test")
+	kp.reload()
+	if host := served(kp); host != "second.test" {
+		t.Fatalf("Certificate wasn’t reloaded, serving %s", host)
+	}
+}
+
+func Test_Renewal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "simplehttp2server")
+	if err != nil {
+		t.Fatalf("Couldn’t create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer func(validFor time.Duration) { caValidFor = validFor }(caValidFor)
+	caValidFor = 10 * time.Minute
+	ca, err := loadCA(dir)
+	if err != nil {
+		t.Fatalf("Couldn’t create CA: %s", err)
+	}
+	expiring := ca.cert
+	ca.GetCertificate(&tls.ClientHelloInfo{ServerName: "localhost"})
+	caValidFor = 24 * time.Hour
+	if err := ca.renew(); err != nil || ca.cert.Equal(expiring) || len(ca.leaves) != 0 {
+		t.Fatalf("Expiring CA wasn’t renewed: %v", err)
+	}
+	if err := ca.renew(); err != nil || expiresSoon(ca.cert) {
+		t.Fatalf("Renewed CA expires soon: %v", err)
+	}
+
+	key, _ := newKey("p256")
+	cert, err := createCertificate([]string{"localhost"}, key, 10*time.Minute, nil, nil)
+	if err != nil {
+		t.Fatalf("Couldn’t create certificate: %s", err)
+	}
+	certPath, keyPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	block, _ := pemBlockForKey(key)
+	writePEM(certPath, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}, 0644)
+	writePEM(keyPath, block, 0600)
+	kp, err := newKeyPair(certPath, keyPath)
+	if err != nil {
+		t.Fatalf("Couldn’t load key pair: %s", err)
+	}
+	kp.checkExpiry()
+	renewed, _ := readCertificate(certPath)
+	if renewed.Equal(cert.Leaf) || !keyMatches(renewed, key) || describeIssuer(renewed) != "self-signed" {
+		t.Fatalf("Expiring certificate wasn’t renewed")
+	}
+	if served, _ := kp.GetCertificate(&tls.ClientHelloInfo{}); !bytes.Equal(served.Certificate[0], renewed.Raw) {
+		t.Fatalf("Renewed certificate isn’t served")
+	}
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var (
+	// Keys of other Firebase products and the JSON schema that can appear
+	// in a firebase.json. They are skipped entirely.
+	foreignKeys = []string{"$schema", "database", "firestore", "functions", "storage", "emulators", "remoteconfig", "extensions", "dataconnect", "apphosting"}
+	// Hosting keys that are valid for Firebase but are ignored by
+	// simplehttp2server.
+	unsupportedKeys = []string{"predeploy", "postdeploy", "frameworksBackend", "source", "dynamicLinks", "pinTag"}
+)
+
+// A configProblem is an issue found in a config file, located by the byte
+// offset of the offending key or value.
+type configProblem struct {
+	offset  int64
+	message string
+	warning bool
+}
+
+func validateCommand(args []string) int {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	config := fs.String("config", "firebase.json", "Config file")
+	fs.Parse(args)
+
+	files := fs.Args()
+	if len(files) == 0 {
+		files = []string{*config}
+	}
+
+	status := 0
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", file, err)
+			status = 1
+			continue
+		}
+		for _, problem := range validateConfig(data) {
+			level := "error"
+			if problem.warning {
+				level = "warning"
+			} else {
+				status = 1
+			}
+			line, col := lineAndColumn(data, problem.offset)
+			fmt.Fprintf(os.Stderr, "%s:%d:%d: %s: %s\n", file, line, col, level, problem.message)
+		}
+	}
+	return status
+}
+
+func lineAndColumn(data []byte, offset int64) (int, int) {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	before := data[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	col := len(before) - bytes.LastIndexByte(before, '\n')
+	return line, col
+}
+
+// validateConfig checks a config for syntax errors, unknown keys, invalid
+// rules and rules that can never match.
+func validateConfig(data []byte) []configProblem {
+	mf := FirebaseManifest{}
+	if err := json.Unmarshal(data, &mf); err != nil {
+		switch err := err.(type) {
+		case *json.SyntaxError:
+			// Offset points behind the offending character, or is 0 for
+			// an empty config.
+			offset := err.Offset - 1
+			if offset < 0 {
+				offset = 0
+			}
+			return []configProblem{{offset: offset, message: err.Error()}}
+		case *json.UnmarshalTypeError:
+			return []configProblem{{offset: err.Offset, message: fmt.Sprintf("%s must be %s, not %s", err.Field, err.Type, err.Value)}}
+		default:
+			return []configProblem{{message: err.Error()}}
+		}
+	}
+
+	cw := &configWalker{
+		data:    data,
+		dec:     json.NewDecoder(bytes.NewReader(data)),
+		offsets: map[string]int64{},
+	}
+	if err := cw.walk("", reflect.TypeOf(mf)); err != nil {
+		return append(cw.problems, configProblem{offset: cw.dec.InputOffset(), message: err.Error()})
+	}
+	redirects, rewrites := cw.checkRules("", mf)
+	if len(mf.Hosting) == 0 {
+		cw.checkShadowed("redirect", redirects)
+		cw.checkShadowed("rewrite", rewrites)
+	}
+	// Every site is checked together with the top-level rules, as that’s
+	// how the ruleset of a site is compiled.
+	for i, hosting := range mf.Hosting {
+		path := "Hosting"
+		if _, ok := cw.offsets[fmt.Sprintf("Hosting[%d]", i)]; ok {
+			path = fmt.Sprintf("Hosting[%d]", i)
+		}
+		if len(mf.Hosting) > 1 && hosting.name() == "" {
+			cw.report(cw.offsets[path], false, "site needs a target or site name")
+		}
+		siteRedirects, siteRewrites := cw.checkRules(path+".", *hosting)
+		cw.checkShadowed("redirect", append(append([]ruleSource{}, redirects...), siteRedirects...))
+		cw.checkShadowed("rewrite", append(append([]ruleSource{}, rewrites...), siteRewrites...))
+	}
+
+	sort.SliceStable(cw.problems, func(i, j int) bool {
+		return cw.problems[i].offset < cw.problems[j].offset
+	})
+	return cw.problems
+}
+
+// A configWalker walks the tokens of a config, records the offset of every
+// value by its path (e.g. `Hosting[1].redirects[0].source`) and reports keys
+// that don’t exist in the FirebaseManifest.
+type configWalker struct {
+	data     []byte
+	dec      *json.Decoder
+	offsets  map[string]int64
+	problems []configProblem
+}
+
+func (cw *configWalker) nextOffset() int64 {
+	offset := cw.dec.InputOffset()
+	for offset < int64(len(cw.data)) && strings.IndexByte(" \t\r\n,:", cw.data[offset]) >= 0 {
+		offset++
+	}
+	return offset
+}
+
+func (cw *configWalker) report(offset int64, warning bool, format string, args ...interface{}) {
+	cw.problems = append(cw.problems, configProblem{offset, fmt.Sprintf(format, args...), warning})
+}
+
+// walk consumes one value of the given type. A nil type skips the value
+// without checking its keys.
+func (cw *configWalker) walk(path string, typ reflect.Type) error {
+	for typ != nil && typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	cw.offsets[path] = cw.nextOffset()
+	tok, err := cw.dec.Token()
+	if err != nil {
+		return err
+	}
+
+	switch tok {
+	case json.Delim('{'):
+		// A single object in place of an array, as `hosting` allows.
+		if typ != nil && typ.Kind() == reflect.Slice {
+			typ = typ.Elem()
+			for typ.Kind() == reflect.Ptr {
+				typ = typ.Elem()
+			}
+		}
+		for cw.dec.More() {
+			offset := cw.nextOffset()
+			tok, err := cw.dec.Token()
+			if err != nil {
+				return err
+			}
+			key := tok.(string)
+
+			var field reflect.Type
+			if typ != nil && typ.Kind() == reflect.Struct {
+				var name string
+				var ok bool
+				name, field, ok = jsonField(typ, key)
+				if ok {
+					key = name
+				}
+				switch {
+				case ok:
+				case path == "" && contains(foreignKeys, key):
+				case contains(unsupportedKeys, key):
+					cw.report(offset, true, "%q is not supported by simplehttp2server and will be ignored", key)
+				default:
+					// Firebase adds keys over time, so keys that aren’t
+					// known don’t fail the validation.
+					cw.report(offset, true, "unknown key %q", key)
+				}
+			}
+			child := key
+			if path != "" {
+				child = path + "." + key
+			}
+			if err := cw.walk(child, field); err != nil {
+				return err
+			}
+		}
+		_, err = cw.dec.Token()
+	case json.Delim('['):
+		var elem reflect.Type
+		if typ != nil && typ.Kind() == reflect.Slice {
+			elem = typ.Elem()
+		}
+		for i := 0; cw.dec.More(); i++ {
+			if err := cw.walk(fmt.Sprintf("%s[%d]", path, i), elem); err != nil {
+				return err
+			}
+		}
+		_, err = cw.dec.Token()
+	}
+	return err
+}
+
+// jsonField finds the name and type of the struct field encoding/json would
+// decode key into. Offsets are recorded under the field name, as
+// encoding/json matches keys case-insensitively.
+func jsonField(typ reflect.Type, key string) (string, reflect.Type, bool) {
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "" {
+			name = field.Name
+		}
+		if strings.EqualFold(name, key) {
+			return name, field.Type, true
+		}
+	}
+	return "", nil, false
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// A ruleSource is the `source` or `regex` of a redirect or rewrite.
+type ruleSource struct {
+	path          string
+	source, regex string
+	pattern       *regexp.Regexp
+}
+
+// sourceOffset returns the offset of the `source` or `regex` of the rule at
+// path, falling back to the rule itself.
+func (cw *configWalker) sourceOffset(path string) int64 {
+	for _, key := range []string{"regex", "source"} {
+		if offset, ok := cw.offsets[path+"."+key]; ok {
+			return offset
+		}
+	}
+	return cw.offsets[path]
+}
+
+// checkRules reports invalid rules and returns the redirects and rewrites
+// in the order the ruleset applies them. Nested sites are not checked.
+func (cw *configWalker) checkRules(prefix string, mf FirebaseManifest) ([]ruleSource, []ruleSource) {
+	for i, glob := range mf.Ignore {
+		if _, err := CompileExtGlob(strings.TrimPrefix(glob, "/")); err != nil {
+			cw.report(cw.offsets[fmt.Sprintf("%signore[%d]", prefix, i)], false, "invalid ignore extglob %s: %s", glob, err)
+		}
+	}
+
+	for mountPrefix, dir := range mf.Mounts {
+		offset := cw.offsets[prefix+"mounts."+mountPrefix]
+		switch {
+		case !strings.HasPrefix(mountPrefix, "/"):
+			cw.report(offset, false, "invalid mount point %s, must start with /", mountPrefix)
+		case dir == "":
+			cw.report(offset, false, "invalid mount point %s, no directory given", mountPrefix)
+		}
+	}
+
+	switch mf.AppAssociation {
+	case "", "AUTO", "NONE":
+	default:
+		cw.report(cw.offsets[prefix+"appAssociation"], false, "invalid appAssociation %q, must be AUTO or NONE", mf.AppAssociation)
+	}
+
+	redirects := []ruleSource{}
+	for i, redirect := range mf.Redirects {
+		path := fmt.Sprintf("%sredirects[%d]", prefix, i)
+		switch redirect.Type {
+		case 0, 301, 302:
+		default:
+			cw.report(cw.offsets[path+".type"], false, "invalid redirect type %d, must be 301 or 302", redirect.Type)
+		}
+		pattern, err := compileSource(redirect.Source, redirect.Regex)
+		if err != nil {
+			cw.report(cw.sourceOffset(path), false, "invalid redirect %s", err)
+			continue
+		}
+		redirects = append(redirects, ruleSource{path, redirect.Source, redirect.Regex, pattern})
+	}
+
+	rewrites := []ruleSource{}
+	for i, rewrite := range mf.Rewrites {
+		path := fmt.Sprintf("%srewrites[%d]", prefix, i)
+		pattern, err := compileSource(rewrite.Source, rewrite.Regex)
+		if err != nil {
+			cw.report(cw.sourceOffset(path), false, "invalid rewrite %s", err)
+			continue
+		}
+		rewrites = append(rewrites, ruleSource{path, rewrite.Source, rewrite.Regex, pattern})
+	}
+
+	for i, page := range mf.NotFoundPages {
+		path := fmt.Sprintf("%snotFoundPages[%d]", prefix, i)
+		if _, err := compileSource(page.Source, page.Regex); err != nil {
+			cw.report(cw.sourceOffset(path), false, "invalid 404 page %s", err)
+		}
+	}
+
+	for i, headerSet := range mf.Headers {
+		path := fmt.Sprintf("%sheaders[%d]", prefix, i)
+		if _, err := compileSource(headerSet.Source, headerSet.Regex); err != nil {
+			cw.report(cw.sourceOffset(path), false, "invalid header %s", err)
+		}
+	}
+
+	return redirects, rewrites
+}
+
+// checkShadowed reports rules that can never match because an earlier rule
+// matches every path they match. Only the cases that can be decided
+// reliably are detected: identical sources, earlier rules that match
+// everything and later rules that match a single literal path.
+func (cw *configWalker) checkShadowed(kind string, rules []ruleSource) {
+	for j, later := range rules {
+		literal, isLiteral := literalPath(later)
+		for _, earlier := range rules[:j] {
+			if (earlier.source == later.source && earlier.regex == later.regex) ||
+				matchesEverything(earlier) ||
+				(isLiteral && earlier.pattern.MatchString(literal)) {
+				line, _ := lineAndColumn(cw.data, cw.offsets[earlier.path])
+				cw.report(cw.sourceOffset(later.path), false, "%s can never match, it is shadowed by the %s on line %d", kind, kind, line)
+				break
+			}
+		}
+	}
+}
+
+func literalPath(rule ruleSource) (string, bool) {
+	if rule.regex != "" {
+		pattern, err := regexp.Compile(rule.regex)
+		if err != nil {
+			return "", false
+		}
+		return pattern.LiteralPrefix()
+	}
+	if strings.ContainsAny(rule.source, "*?+@![]\\:") {
+		return "", false
+	}
+	return "/" + strings.TrimPrefix(rule.source, "/"), true
+}
+
+func matchesEverything(rule ruleSource) bool {
+	if rule.regex != "" {
+		return rule.regex == ".*"
+	}
+	return strings.TrimPrefix(rule.source, "/") == "**"
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func Test_ValidateConfig(t *testing.T) {
+	config := `{
+  "hosting": {
+    "cleanUrl": true,
+    "redirects": [
+      {"source": "/a/**", "destination": "/b", "type": 303},
+      {"source": "/a/c", "destination": "/d"},
+      {"source": "/x/@(", "destination": "/d"}
+    ],
+    "rewrites": [
+      {"source": "**", "destination": "/index.html"},
+      {"regex": "/app/.*", "destination": "/app.html"}
+    ],
+    "ignore": ["firebase.json", "**/.*", "**/node_modules/**"]
+  },
+  "database": {"rules": "database.rules.json"}
+}`
+	expected := []struct {
+		Line, Column int
+		Message      string
+	}{
+		{3, 5, `unknown key "cleanUrl"`},
+		{5, 56, "invalid redirect type 303"},
+		{6, 18, "shadowed by the redirect on line 5"},
+		{7, 18, "invalid redirect extglob /x/@("},
+		{11, 17, "shadowed by the rewrite on line 10"},
+	}
+
+	problems := validateConfig([]byte(config))
+	if len(problems) != len(expected) {
+		t.Fatalf("Expected %d problems, got %d: %v", len(expected), len(problems), problems)
+	}
+	for i, problem := range problems {
+		line, col := lineAndColumn([]byte(config), problem.offset)
+		if line != expected[i].Line || col != expected[i].Column || !strings.Contains(problem.message, expected[i].Message) {
+			t.Fatalf("Expected %q at %d:%d, got %q at %d:%d", expected[i].Message, expected[i].Line, expected[i].Column, problem.message, line, col)
+		}
+	}
+
+	problems = validateConfig([]byte(`{"redirects": [}`))
+	if len(problems) != 1 {
+		t.Fatalf("Syntax error wasn’t reported: %v", problems)
+	}
+	if line, col := lineAndColumn([]byte(`{"redirects": [}`), problems[0].offset); line != 1 || col != 16 {
+		t.Fatalf("Syntax error reported at %d:%d", line, col)
+	}
+
+	for _, truncated := range []struct {
+		Config       string
+		Line, Column int
+	}{
+		{"", 1, 1},
+		{"{\n  \"hosting\": {\n", 2, 15},
+	} {
+		problems = validateConfig([]byte(truncated.Config))
+		if len(problems) != 1 || !strings.Contains(problems[0].message, "unexpected end of JSON input") {
+			t.Fatalf("Syntax error in %q wasn’t reported: %v", truncated.Config, problems)
+		}
+		if line, col := lineAndColumn([]byte(truncated.Config), problems[0].offset); line != truncated.Line || col != truncated.Column {
+			t.Fatalf("Syntax error in %q reported at %d:%d", truncated.Config, line, col)
+		}
+	}
+
+	config = `{
+  "hosting": [
+    {"target": "app", "rewrites": [{"source": "**", "destination": "/index.html"}, {"source": "/a", "destination": "/a.html"}]},
+    {"public": "admin", "cleanUrl": true}
+  ]
+}`
+	problems = validateConfig([]byte(config))
+	if len(problems) != 3 {
+		t.Fatalf("Expected 3 problems, got %d: %v", len(problems), problems)
+	}
+	for i, expected := range []string{"shadowed by the rewrite on line 3", "needs a target", `unknown key "cleanUrl"`} {
+		if !strings.Contains(problems[i].message, expected) {
+			t.Fatalf("Expected %q, got %q", expected, problems[i].message)
+		}
+	}
+
+	// Documented Firebase keys simplehttp2server ignores and keys it doesn’t
+	// know are only warnings.
+	config = `{
+  "$schema": "https://raw.githubusercontent.com/firebase/firebase-tools/master/schema/firebase-config.json",
+  "hosting": {
+    "rewrites": [
+      {"source": "/link/**", "dynamicLinks": true},
+      {"source": "/api/**", "run": {"serviceId": "api", "pinTag": true}}
+    ],
+    "newFeature": {}
+  }
+}`
+	problems = validateConfig([]byte(config))
+	if len(problems) != 3 {
+		t.Fatalf("Expected 3 problems, got %d: %v", len(problems), problems)
+	}
+	for i, expected := range []string{`"dynamicLinks" is not supported`, `"pinTag" is not supported`, `unknown key "newFeature"`} {
+		if !strings.Contains(problems[i].message, expected) || !problems[i].warning {
+			t.Fatalf("Expected warning %q, got %v", expected, problems[i])
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	watchInterval = 1 * time.Second
+)
+
+// watchFiles calls onChange whenever the modification time or size of one
+// of the given files changes. Files that don’t exist are watched until they
+// are created.
+func watchFiles(onChange func(), paths ...string) {
+	stat := func() []string {
+		stamps := make([]string, len(paths))
+		for i, path := range paths {
+			if fi, err := os.Stat(path); err == nil {
+				stamps[i] = fmt.Sprintf("%s/%d", fi.ModTime(), fi.Size())
+			}
+		}
+		return stamps
+	}
+
+	last := stat()
+	for range time.Tick(watchInterval) {
+		current := stat()
+		for i := range current {
+			if current[i] != last[i] {
+				last = current
+				onChange()
+				break
+			}
+		}
+	}
+}
+
+// A configWatcher holds the ruleset compiled from a config file and swaps
+// in a new ruleset whenever the file changes. If the changed file is
+// invalid, the last valid ruleset is kept.
+type configWatcher struct {
+	path, target string
+	// base is the directory relative dirs of the config are resolved
+	// against, the working directory if empty.
+	base  string
+	rules atomic.Value
+}
+
+func newConfigWatcher(path, target, base string) (*configWatcher, error) {
+	cw := &configWatcher{path: path, target: target, base: base}
+	rs, err := cw.load()
+	if err != nil {
+		return nil, err
+	}
+	cw.rules.Store(rs)
+	go watchFiles(cw.reload, path)
+	return cw, nil
+}
+
+func (cw *configWatcher) load() (*ruleset, error) {
+	rs, err := loadRuleset(cw.path, cw.target)
+	if err != nil {
+		return nil, err
+	}
+	if cw.base != "" {
+		rs.rebase(cw.base)
+	}
+	return rs, nil
+}
+
+func (cw *configWatcher) reload() {
+	rs, err := cw.load()
+	if err != nil {
+		log.Printf("Config %s is invalid, keeping the previous config: %s", cw.path, err)
+		return
+	}
+	cw.rules.Store(rs)
+	log.Printf("Reloaded config %s", cw.path)
+}
+
+func (cw *configWatcher) Ruleset() *ruleset {
+	return cw.rules.Load().(*ruleset)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// An appConfig lists the apps of a project, which Firebase generates the
+// app association files for.
+type appConfig struct {
+	Android []struct {
+		PackageName            string   `json:"packageName"`
+		SHA256CertFingerprints []string `json:"sha256CertFingerprints"`
+	} `json:"android"`
+	IOS []struct {
+		// AppID is the bundle ID prefixed with the team ID.
+		AppID string `json:"appId"`
+	} `json:"ios"`
+}
+
+// localApps holds the app config given with `-apps`, if any.
+var localApps *appConfig
+
+func readApps(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	ac := &appConfig{}
+	if err := json.NewDecoder(f).Decode(ac); err != nil {
+		return err
+	}
+	localApps = ac
+	return nil
+}
+
+func (ac *appConfig) assetLinks() interface{} {
+	type target struct {
+		Namespace              string   `json:"namespace"`
+		PackageName            string   `json:"package_name"`
+		SHA256CertFingerprints []string `json:"sha256_cert_fingerprints"`
+	}
+	type statement struct {
+		Relation []string `json:"relation"`
+		Target   target   `json:"target"`
+	}
+	statements := []statement{}
+	for _, app := range ac.Android {
+		statements = append(statements, statement{
+			Relation: []string{"delegate_permission/common.handle_all_urls"},
+			Target:   target{"android_app", app.PackageName, app.SHA256CertFingerprints},
+		})
+	}
+	return statements
+}
+
+func (ac *appConfig) appleAppSiteAssociation() interface{} {
+	type detail struct {
+		AppID string   `json:"appID"`
+		Paths []string `json:"paths"`
+	}
+	details := []detail{}
+	appIDs := []string{}
+	for _, app := range ac.IOS {
+		details = append(details, detail{app.AppID, []string{"NOT /_/*", "/*"}})
+		appIDs = append(appIDs, app.AppID)
+	}
+	return map[string]interface{}{
+		"applinks": map[string]interface{}{
+			"apps":    []string{},
+			"details": details,
+		},
+		"webcredentials": map[string]interface{}{
+			"apps": appIDs,
+		},
+	}
+}
+
+// serveAppAssociation serves the generated `assetlinks.json` and
+// `apple-app-site-association` if `appAssociation` is `AUTO` and the files
+// don’t exist in the public dir.
+func serveAppAssociation(w http.ResponseWriter, r *http.Request, root http.FileSystem) bool {
+	if localApps == nil {
+		return false
+	}
+	var doc interface{}
+	switch r.URL.Path {
+	case "/.well-known/assetlinks.json":
+		doc = localApps.assetLinks()
+	case "/.well-known/apple-app-site-association", "/apple-app-site-association":
+		doc = localApps.appleAppSiteAssociation()
+	default:
+		return false
+	}
+	if f, err := root.Open(r.URL.Path); err == nil {
+		f.Close()
+		return false
+	}
+
+	log.Printf("--> Generated %s", r.URL.Path)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(doc)
+	return true
+}
+
+// isWellKnownJSON reports whether the path is an extensionless
+// `.well-known` file, which are JSON documents.
+func isWellKnownJSON(p string) bool {
+	return (strings.HasPrefix(p, "/.well-known/") || p == "/apple-app-site-association") &&
+		!strings.HasSuffix(p, "/") && path.Ext(p) == ""
+}